@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedAPI means qBittorrent's Web API is too old for this tool.
+// Retrying cannot help, so startup fails at once.
+var ErrUnsupportedAPI = errors.New("unsupported qBittorrent Web API")
+
+// minWebAPIVersion is the oldest Web API known to work: 2.0 shipped with
+// qBittorrent 4.1, which introduced /api/v2.
+var minWebAPIVersion = []int{2, 0}
+
+// checkAPIVersion asks qBittorrent for its Web API version once per client
+// and rejects versions below minWebAPIVersion. Other failures only log a
+// warning: the version is for diagnostics and is retried on the next login.
+func (c *QBittorrentClient) checkAPIVersion(ctx context.Context) error {
+	if c.apiVersion != "" {
+		return nil
+	}
+	const op = "webapi_version"
+
+	resp, err := c.get(ctx, op, c.apiVersionURL)
+	if err != nil {
+		return newAPIError(op, c.apiVersionURL, 0, err, "Web API version request failed")
+	}
+	defer resp.Body.Close()
+
+	// Before 4.1 there is no /api/v2 at all.
+	if resp.StatusCode == http.StatusNotFound {
+		return newAPIError(op, c.apiVersionURL, resp.StatusCode, ErrUnsupportedAPI, "Web API v2 not found; qBittorrent 4.1 or newer is required")
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Could not determine qBittorrent Web API version", "url", c.String(), "status_code", resp.StatusCode)
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return newAPIError(op, c.apiVersionURL, resp.StatusCode, err, "failed to read Web API version")
+	}
+	version := strings.TrimSpace(string(body))
+	parsed, ok := parseAPIVersion(version)
+	if !ok {
+		slog.Warn("Unrecognized qBittorrent Web API version", "url", c.String(), "webapi_version", version)
+		return nil
+	}
+	if compareVersions(parsed, minWebAPIVersion) < 0 {
+		return newAPIError(op, c.apiVersionURL, resp.StatusCode, ErrUnsupportedAPI,
+			fmt.Sprintf("Web API %s is older than the minimum supported %s", version, formatVersion(minWebAPIVersion)))
+	}
+
+	c.apiVersion = version
+	slog.Info("Detected qBittorrent Web API version", "url", c.String(), "webapi_version", version)
+	return nil
+}
+
+func parseAPIVersion(s string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	version := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		version[i] = n
+	}
+	return version, true
+}
+
+// compareVersions compares dotted versions component by component; missing
+// components count as zero, so 2.0 equals 2.0.0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(v []int) string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseListenPort accepts the port preference key as a JSON number or a
+// numeric string; builds and forks have used both.
+func parseListenPort(key string, raw json.RawMessage) (int, error) {
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return 0, fmt.Errorf("%s has unexpected value %s", key, raw)
+	}
+	if port, err := n.Int64(); err == nil {
+		return int(port), nil
+	}
+	if f, err := n.Float64(); err == nil && f == float64(int(f)) {
+		return int(f), nil
+	}
+	return 0, fmt.Errorf("%s has unexpected value %s", key, raw)
+}
+
+// portLikeKeys lists the preference keys that mention a port and hold a
+// number, for pointing LISTEN_PORT_KEY at the right one on forks that rename
+// listen_port.
+func portLikeKeys(prefs map[string]json.RawMessage) []string {
+	var keys []string
+	for key, raw := range prefs {
+		if _, err := parseListenPort(key, raw); err == nil && strings.Contains(strings.ToLower(key), "port") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// backoffPolicy describes exponential backoff with full jitter: the n-th
+// wait is uniform in [0, min(maxDelay, baseDelay*2^n)], which spreads out
+// retries from several instances hitting the same qBittorrent.
+type backoffPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	clock       clock
+}
+
+func newBackoffPolicy(config *Config) backoffPolicy {
+	return backoffPolicy{
+		maxAttempts: config.MaxRetries + 1,
+		baseDelay:   config.RetryBaseDelay,
+		maxDelay:    config.RetryMaxDelay,
+		clock:       realClock{},
+	}
+}
+
+func (p backoffPolicy) delay(attempt int) time.Duration {
+	ceiling := p.maxDelay
+	if attempt < 32 {
+		if d := p.baseDelay << attempt; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryWithBackoff calls fn until it succeeds, fails with an error that is
+// not worth retrying, or has been tried maxAttempts times. Cancelling ctx
+// ends the wait immediately.
+func retryWithBackoff(ctx context.Context, p backoffPolicy, operation string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt+1 >= p.maxAttempts || !retryable(ctx, err) {
+			return err
+		}
+
+		wait := p.delay(attempt)
+		slog.Debug("Retrying after transient error", append([]any{"operation", operation, "attempt", attempt + 1, "retry_in", wait.Round(time.Millisecond)}, errAttrs(err)...)...)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-p.clock.After(wait):
+		}
+	}
+}
+
+// retryable reports whether err looks transient: a 5xx from the client, a
+// refused or reset connection, a timeout, or a temporary DNS failure. Other
+// HTTP statuses are answers that a retry would only repeat; authentication
+// problems are left to the re-login logic, and a host that does not resolve
+// at all to the DNS backoff in the sync loop.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode != 0 {
+		return apiErr.StatusCode >= 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withRetries wraps client in a retryingClient. The instances of a
+// multiClient are wrapped one by one, so a retry only repeats the instance
+// that failed.
+func withRetries(client TorrentClient, policy backoffPolicy) TorrentClient {
+	if m, ok := client.(*multiClient); ok {
+		for i, inst := range m.instances {
+			m.instances[i] = &retryingClient{TorrentClient: inst, policy: policy}
+		}
+		return m
+	}
+	return &retryingClient{TorrentClient: client, policy: policy}
+}
+
+// retryingClient retries the calls a sync depends on; everything else goes
+// straight to the wrapped client.
+type retryingClient struct {
+	TorrentClient
+	policy backoffPolicy
+}
+
+func (c *retryingClient) Login(ctx context.Context) error {
+	return retryWithBackoff(ctx, c.policy, "login", func() error {
+		return c.TorrentClient.Login(ctx)
+	})
+}
+
+func (c *retryingClient) GetListeningPort(ctx context.Context) (int, error) {
+	var port int
+	err := retryWithBackoff(ctx, c.policy, "get_listening_port", func() error {
+		var err error
+		port, err = c.TorrentClient.GetListeningPort(ctx)
+		return err
+	})
+	return port, err
+}
+
+func (c *retryingClient) SetListeningPort(ctx context.Context, port int) error {
+	return retryWithBackoff(ctx, c.policy, "set_listening_port", func() error {
+		return c.TorrentClient.SetListeningPort(ctx, port)
+	})
+}
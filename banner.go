@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bannerMarker records the hash of the last configuration logged in full.
+var bannerMarker = filepath.Join(os.TempDir(), "qbittorrent-port-sync.banner")
+
+// logConfigBanner logs the full configuration, unless the same configuration
+// was logged within BANNER_QUIET_PERIOD. A crashloop then repeats one short
+// line per restart instead of the whole banner.
+func logConfigBanner(config *Config) {
+	attrs := configAttrs(config)
+	hash := configHash(attrs)
+
+	if config.BannerQuietPeriod > 0 {
+		if info, err := os.Stat(bannerMarker); err == nil && time.Since(info.ModTime()) < config.BannerQuietPeriod {
+			if prev, err := os.ReadFile(bannerMarker); err == nil && strings.TrimSpace(string(prev)) == hash {
+				slog.Info("Configuration loaded (unchanged since last start)", "config_hash", hash, "last_start", info.ModTime().Round(time.Second))
+				touchBannerMarker(hash)
+				return
+			}
+		}
+	}
+
+	slog.Info("Configuration loaded", append(attrs, "config_hash", hash)...)
+	if config.BannerQuietPeriod > 0 {
+		touchBannerMarker(hash)
+	}
+}
+
+func configHash(attrs []any) string {
+	h := sha256.New()
+	for _, a := range attrs {
+		fmt.Fprintf(h, "%v\x00", a)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// touchBannerMarker is best effort; without it we just log the full banner.
+func touchBannerMarker(hash string) {
+	if err := os.WriteFile(bannerMarker, []byte(hash+"\n"), 0o644); err != nil {
+		slog.Debug("Failed to write banner marker", "path", bannerMarker, "error", err)
+	}
+}
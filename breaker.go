@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// circuitBreaker stops a client that keeps failing from being retried every
+// tick. After BREAKER_THRESHOLD cycles in a row fail on qBittorrent calls it
+// opens, and cycles are skipped except for one probe every BREAKER_INTERVAL;
+// the first successful sync closes it again.
+type circuitBreaker struct {
+	threshold int
+	interval  time.Duration
+
+	failures  int
+	openSince time.Time
+	nextProbe time.Time
+	// open counts the open breakers across lanes, for /status and metrics.
+	open *atomic.Int64
+}
+
+func newCircuitBreaker(config *Config, open *atomic.Int64) *circuitBreaker {
+	return &circuitBreaker{threshold: config.BreakerThreshold, interval: config.BreakerInterval, open: open}
+}
+
+// blocking reports whether the cycle at now should be skipped.
+func (b *circuitBreaker) blocking(now time.Time) bool {
+	return !b.openSince.IsZero() && now.Before(b.nextProbe)
+}
+
+// failed records a cycle that failed on the client.
+func (b *circuitBreaker) failed(client string, now time.Time) {
+	if b.threshold == 0 {
+		return
+	}
+	b.failures++
+	if !b.openSince.IsZero() {
+		b.nextProbe = now.Add(b.interval)
+		slog.Warn("Circuit breaker probe failed, staying open", "client", client, "failures", b.failures,
+			"open_for", now.Sub(b.openSince).Round(time.Second), "next_probe", b.nextProbe.Format(time.TimeOnly))
+		return
+	}
+	if b.failures >= b.threshold {
+		b.openSince = now
+		b.nextProbe = now.Add(b.interval)
+		b.open.Add(1)
+		slog.Error("qBittorrent keeps failing, opening circuit breaker and checking less often", "client", client,
+			"failures", b.failures, "probe_interval", b.interval)
+	}
+}
+
+func (b *circuitBreaker) succeeded(client string, now time.Time) {
+	if !b.openSince.IsZero() {
+		slog.Info("Sync succeeded, closing circuit breaker", "client", client, "open_for", now.Sub(b.openSince).Round(time.Second))
+		b.openSince = time.Time{}
+		b.open.Add(-1)
+	}
+	b.failures = 0
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Values for CLIENT_TYPE.
+const (
+	clientQBittorrent  = "qbittorrent"
+	clientTransmission = "transmission"
+	clientDeluge       = "deluge"
+)
+
+// TorrentClient is what the sync loop needs from a torrent client.
+type TorrentClient interface {
+	Login(ctx context.Context) error
+	CheckHealth(ctx context.Context) error
+	CheckSession(ctx context.Context) error
+	GetListeningPort(ctx context.Context) (int, error)
+	SetListeningPort(ctx context.Context, port int) error
+	// ValidateSetPayload builds the request that SetListeningPort would send
+	// and returns a printable form of it, without sending anything.
+	ValidateSetPayload(port int) (string, error)
+	CountActiveTorrents(ctx context.Context) (int, error)
+	ConnectionStatus(ctx context.Context) (string, error)
+	Version(ctx context.Context) (string, error)
+	GetPreferencesRaw(ctx context.Context) ([]byte, error)
+	SetPreferencesRaw(ctx context.Context, prefs []byte) error
+	String() string
+}
+
+// newTorrentClient builds the client selected by CLIENT_TYPE. For qBittorrent,
+// QBITTORRENT_URL is a comma-separated list of independent instances, each
+// kept on the forwarded port by a multiClient. Within an instance, several
+// addresses separated by "|" describe one logical service reachable at
+// multiple addresses (an active/standby pair) and are wrapped in an haClient.
+func newTorrentClient(config *Config) (TorrentClient, error) {
+	switch config.ClientType {
+	case clientTransmission:
+		logTLSSettings(config, []string{config.TransmissionURL})
+		return NewTransmissionClient(config.TransmissionURL, newTransport(config), config), nil
+	case clientDeluge:
+		logTLSSettings(config, []string{config.DelugeURL})
+		return NewDelugeClient(config.DelugeURL, newTransport(config), config)
+	}
+
+	groups := splitList(config.QBittorrentURL, ",")
+	logTLSSettings(config, splitList(strings.ReplaceAll(config.QBittorrentURL, ",", "|"), "|"))
+	if len(groups) == 0 {
+		return nil, errors.New("QBITTORRENT_URL is empty")
+	}
+
+	shared := newTransport(config)
+	instances := make([]TorrentClient, 0, len(groups))
+	for _, group := range groups {
+		instance, err := newQBittorrentInstance(splitList(group, "|"), shared, config)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	if len(instances) == 1 {
+		return instances[0], nil
+	}
+	return &multiClient{instances: instances, ports: make([]int, len(instances)), concurrency: config.StartupConcurrency}, nil
+}
+
+func newQBittorrentInstance(urls []string, shared http.RoundTripper, config *Config) (TorrentClient, error) {
+	endpoints := make([]TorrentClient, 0, len(urls))
+	for _, u := range urls {
+		transport := shared
+		if config.TransportMode == transportPerInstance {
+			transport = newTransport(config)
+		}
+		client, err := NewQBittorrentClient(u, transport, config)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, client)
+	}
+	if len(endpoints) == 1 {
+		return endpoints[0], nil
+	}
+	return &haClient{endpoints: endpoints, concurrency: config.StartupConcurrency}, nil
+}
+
+func splitList(value, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// haClient fans a single logical qBittorrent service out to several
+// addresses. Reads come from the first endpoint that answers; writes go to
+// every endpoint and succeed as long as at least one accepts them, so a
+// standby being down does not fail the sync.
+type haClient struct {
+	endpoints   []TorrentClient
+	concurrency int
+}
+
+// Login logs in to every endpoint, at most STARTUP_CONCURRENCY at a time, so
+// a large set comes up quickly without hammering WebUI ban thresholds.
+func (h *haClient) Login(ctx context.Context) error {
+	failed := forEachInstance(ctx, h.endpoints, h.concurrency, func(ctx context.Context, ep TorrentClient) error {
+		err := ep.Login(ctx)
+		if err != nil {
+			slog.Warn("Login failed on endpoint", append([]any{"endpoint", ep.String()}, errAttrs(err)...)...)
+		}
+		return err
+	})
+	slog.Info("Endpoint logins finished", "succeeded", len(h.endpoints)-len(failed), "failed", len(failed))
+	if len(failed) == len(h.endpoints) {
+		return fmt.Errorf("login failed on all %d endpoints: %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
+
+func (h *haClient) CheckHealth(ctx context.Context) error {
+	var errs []error
+	for _, ep := range h.endpoints {
+		err := ep.CheckHealth(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no endpoint is healthy: %w", errors.Join(errs...))
+}
+
+// CheckSession re-authenticates any endpoint whose session has expired, so
+// the caller never needs to know which one it was.
+func (h *haClient) CheckSession(ctx context.Context) error {
+	var errs []error
+	for _, ep := range h.endpoints {
+		if _, err := withReauth(ctx, ep, func() (int, error) { return 0, ep.CheckSession(ctx) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(h.endpoints) {
+		return fmt.Errorf("session check failed on all %d endpoints: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+func (h *haClient) GetListeningPort(ctx context.Context) (int, error) {
+	var errs []error
+	for _, ep := range h.endpoints {
+		port, err := withReauth(ctx, ep, func() (int, error) { return ep.GetListeningPort(ctx) })
+		if err == nil {
+			return port, nil
+		}
+		slog.Warn("Failed to read port from endpoint", append([]any{"endpoint", ep.String()}, errAttrs(err)...)...)
+		errs = append(errs, err)
+	}
+	return 0, fmt.Errorf("no endpoint answered: %w", errors.Join(errs...))
+}
+
+func (h *haClient) SetListeningPort(ctx context.Context, port int) error {
+	var errs []error
+	for _, ep := range h.endpoints {
+		_, err := withReauth(ctx, ep, func() (int, error) { return 0, ep.SetListeningPort(ctx, port) })
+		if err != nil {
+			slog.Warn("Failed to set port on endpoint", append([]any{"endpoint", ep.String(), "port", port}, errAttrs(err)...)...)
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Set port on endpoint", "endpoint", ep.String(), "port", port)
+	}
+	if len(errs) == len(h.endpoints) {
+		return fmt.Errorf("set failed on all %d endpoints: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+func (h *haClient) CountActiveTorrents(ctx context.Context) (int, error) {
+	var errs []error
+	for _, ep := range h.endpoints {
+		n, err := withReauth(ctx, ep, func() (int, error) { return ep.CountActiveTorrents(ctx) })
+		if err == nil {
+			return n, nil
+		}
+		errs = append(errs, err)
+	}
+	return 0, fmt.Errorf("no endpoint answered: %w", errors.Join(errs...))
+}
+
+// ConnectionStatus reports the best status among the endpoints, so a standby
+// that is not listening does not mask a connected primary.
+func (h *haClient) ConnectionStatus(ctx context.Context) (string, error) {
+	var errs []error
+	best := ""
+	for _, ep := range h.endpoints {
+		var status string
+		_, err := withReauth(ctx, ep, func() (int, error) {
+			var err error
+			status, err = ep.ConnectionStatus(ctx)
+			return 0, err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if status == "connected" {
+			return status, nil
+		}
+		if best == "" || status == "firewalled" {
+			best = status
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no endpoint answered: %w", errors.Join(errs...))
+	}
+	return best, nil
+}
+
+func (h *haClient) Version(ctx context.Context) (string, error) {
+	var version string
+	err := firstAnswer(ctx, h.endpoints, func(ep TorrentClient) (err error) {
+		version, err = ep.Version(ctx)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("no endpoint answered: %w", err)
+	}
+	return version, nil
+}
+
+func (h *haClient) GetPreferencesRaw(ctx context.Context) ([]byte, error) {
+	var data []byte
+	err := firstAnswer(ctx, h.endpoints, func(ep TorrentClient) (err error) {
+		data, err = ep.GetPreferencesRaw(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no endpoint answered: %w", err)
+	}
+	return data, nil
+}
+
+func (h *haClient) SetPreferencesRaw(ctx context.Context, prefs []byte) error {
+	errs := forEachInstance(ctx, h.endpoints, h.concurrency, func(ctx context.Context, ep TorrentClient) error {
+		_, err := withReauth(ctx, ep, func() (int, error) { return 0, ep.SetPreferencesRaw(ctx, prefs) })
+		if err != nil {
+			slog.Warn("Failed to set preferences on endpoint", append([]any{"endpoint", ep.String()}, errAttrs(err)...)...)
+		}
+		return err
+	})
+	if len(errs) == len(h.endpoints) {
+		return fmt.Errorf("set failed on all %d endpoints: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+func (h *haClient) ValidateSetPayload(port int) (string, error) {
+	return h.endpoints[0].ValidateSetPayload(port)
+}
+
+func (h *haClient) String() string {
+	names := make([]string, len(h.endpoints))
+	for i, ep := range h.endpoints {
+		names[i] = ep.String()
+	}
+	return strings.Join(names, " | ")
+}
+
+// withReauth runs fn and, if the endpoint's session expired, logs in to that
+// endpoint and runs it once more. Endpoints keep separate sessions, so the
+// sync loop's own re-auth can't target the one that expired.
+func withReauth(ctx context.Context, ep TorrentClient, fn func() (int, error)) (int, error) {
+	v, err := fn()
+	if err == nil || !errors.Is(err, ErrAuthExpired) {
+		return v, err
+	}
+	if err := ep.Login(ctx); err != nil {
+		return 0, err
+	}
+	return fn()
+}
+
+// forEachInstance runs fn on every client, at most limit at a time, and
+// returns the errors of those that failed in client order.
+func forEachInstance(ctx context.Context, clients []TorrentClient, limit int, fn func(context.Context, TorrentClient) error) []error {
+	errs := make([]error, len(clients))
+	sem := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c TorrentClient) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+// firstAnswer runs fn on each client in turn, re-authenticating where the
+// session expired, and stops at the first that succeeds. It returns nil then,
+// or all the errors joined.
+func firstAnswer(ctx context.Context, clients []TorrentClient, fn func(TorrentClient) error) error {
+	var errs []error
+	for _, c := range clients {
+		_, err := withReauth(ctx, c, func() (int, error) { return 0, fn(c) })
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// clock is where the sync loop, the scheduler and the retry backoff get the
+// time from, so tests can move it forward instead of sleeping.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when Advance is called. After channels fire once the
+// clock reaches their deadline.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+}
+
+// blockUntil waits for n goroutines to be waiting on After, so the test
+// advances the clock only once the code under test is parked on it.
+func (c *fakeClock) blockUntil(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d clock waiters, have %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSuspendAwareTickerFiresEveryInterval(t *testing.T) {
+	clk := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticker := newSuspendAwareTicker(ctx, clk, 30*time.Second)
+
+	// The clock is checked every 5s; nothing fires before 30s have passed.
+	for i := 0; i < 5; i++ {
+		clk.blockUntil(t, 1)
+		clk.Advance(5 * time.Second)
+	}
+	clk.blockUntil(t, 1)
+	select {
+	case <-ticker.C:
+		t.Fatal("ticked before the interval elapsed")
+	default:
+	}
+
+	clk.Advance(5 * time.Second)
+	select {
+	case <-ticker.C:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no tick after the interval elapsed")
+	}
+}
+
+func TestSuspendAwareTickerCatchesUpOnce(t *testing.T) {
+	clk := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticker := newSuspendAwareTicker(ctx, clk, time.Minute)
+
+	clk.blockUntil(t, 1)
+	clk.Advance(2 * time.Hour)
+	select {
+	case <-ticker.C:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no catch-up tick after the clock jumped")
+	}
+
+	clk.blockUntil(t, 1)
+	select {
+	case <-ticker.C:
+		t.Fatal("more than one catch-up tick")
+	default:
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig holds CONFIG_FILE values keyed by environment variable name. The
+// environment always wins; a file value only fills in a variable that is
+// unset, ahead of the built-in default.
+var fileConfig map[string]string
+
+// configKeysRead records every setting loadConfig asked for, so keys in the
+// file that nothing reads can be reported instead of silently ignored.
+var configKeysRead = map[string]bool{}
+
+// lookupEnv returns the command-line or environment value of key, falling
+// back to CONFIG_FILE.
+func lookupEnv(key string) string {
+	configKeysRead[key] = true
+	if value := flagValues[key]; value != "" {
+		return value
+	}
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileConfig[key]
+}
+
+// readConfigFile parses a flat YAML or TOML file, chosen by extension. Keys
+// are the environment variable names, in any case (check_interval or
+// CHECK_INTERVAL); lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unsupported extension %q (want .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		name := strings.ToUpper(key)
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("%s: key %q appears more than once", path, key)
+		}
+		value, err := configValueString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, key, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+func configValueString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value of type %T", v)
+	}
+}
+
+// unknownConfigKeys returns the CONFIG_FILE keys loadConfig never read.
+func unknownConfigKeys() []string {
+	var unknown []string
+	for key := range fileConfig {
+		if !configKeysRead[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
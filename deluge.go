@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync/atomic"
+)
+
+// delugeNotAuthenticated is the JSON-RPC error code the Web UI returns once
+// the session cookie has expired.
+const delugeNotAuthenticated = 1
+
+// DelugeClient talks to the Deluge Web UI's JSON-RPC endpoint. The Web UI is
+// a proxy to a daemon, so Login also makes sure it is connected to one.
+type DelugeClient struct {
+	baseURL    string
+	rpcURL     string
+	password   string
+	httpClient *http.Client
+	nextID     atomic.Int64
+	// rangeSize is PORT_RANGE, the width of listen_ports.
+	rangeSize int
+}
+
+func NewDelugeClient(baseURL string, transport http.RoundTripper, config *Config) (*DelugeClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return &DelugeClient{
+		baseURL:    baseURL,
+		rpcURL:     baseURL + "/json",
+		password:   config.DelugePassword,
+		httpClient: &http.Client{Transport: transport, Jar: jar},
+		rangeSize:  max(config.PortRange, 1),
+	}, nil
+}
+
+type delugeRequest struct {
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+	ID     int64  `json:"id"`
+}
+
+type delugeResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+}
+
+func (c *DelugeClient) call(ctx context.Context, method string, out any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(delugeRequest{Method: method, Params: params, ID: c.nextID.Add(1)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return newAPIError(method, c.rpcURL, 0, err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return newAPIError(method, c.rpcURL, 0, err, "request failed")
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(method, c.rpcURL, resp.StatusCode, nil, fmt.Sprintf("unexpected status code: %d", resp.StatusCode))
+	}
+
+	var result delugeResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to decode response")
+	}
+	if result.Error != nil {
+		if result.Error.Code == delugeNotAuthenticated {
+			return newAPIError(method, c.rpcURL, resp.StatusCode, ErrAuthExpired, "request rejected")
+		}
+		return newAPIError(method, c.rpcURL, resp.StatusCode, nil, "rpc error: "+result.Error.Message)
+	}
+	if out != nil {
+		if err := json.Unmarshal(result.Result, out); err != nil {
+			return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to decode result")
+		}
+	}
+	return nil
+}
+
+func (c *DelugeClient) Login(ctx context.Context) error {
+	var ok bool
+	if err := c.call(ctx, "auth.login", &ok, c.password); err != nil {
+		return err
+	}
+	if !ok {
+		return newAPIError("auth.login", c.rpcURL, http.StatusOK, ErrInvalidCredentials, "login failed")
+	}
+	if err := c.connectDaemon(ctx); err != nil {
+		return err
+	}
+	slog.Info("Successfully authenticated with Deluge")
+	return nil
+}
+
+// connectDaemon connects the Web UI to the first configured daemon if it is
+// not already connected; without one every core.* call fails.
+func (c *DelugeClient) connectDaemon(ctx context.Context) error {
+	var connected bool
+	if err := c.call(ctx, "web.connected", &connected); err != nil {
+		return err
+	}
+	if connected {
+		return nil
+	}
+
+	var hosts [][]any
+	if err := c.call(ctx, "web.get_hosts", &hosts); err != nil {
+		return err
+	}
+	if len(hosts) == 0 || len(hosts[0]) == 0 {
+		return newAPIError("web.get_hosts", c.rpcURL, http.StatusOK, nil, "Deluge Web UI has no daemon configured")
+	}
+	hostID, _ := hosts[0][0].(string)
+	slog.Info("Connecting Deluge Web UI to daemon", "host_id", hostID)
+	return c.call(ctx, "web.connect", nil, hostID)
+}
+
+// CheckHealth only needs the Web UI to answer.
+func (c *DelugeClient) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/", nil)
+	if err != nil {
+		return newAPIError("health", c.baseURL, 0, err, "failed to create request")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return newAPIError("health", c.baseURL, 0, err, "web ui request failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return newAPIError("health", c.baseURL, resp.StatusCode, nil, fmt.Sprintf("unexpected status code: %d", resp.StatusCode))
+	}
+	return nil
+}
+
+func (c *DelugeClient) CheckSession(ctx context.Context) error {
+	var valid bool
+	if err := c.call(ctx, "auth.check_session", &valid); err != nil {
+		return err
+	}
+	if !valid {
+		return newAPIError("auth.check_session", c.rpcURL, http.StatusOK, ErrAuthExpired, "request rejected")
+	}
+	return nil
+}
+
+// GetListeningPort returns the low end of Deluge's listen_ports range. A
+// range of the wrong width is reported as port 0, so the sync rewrites it.
+func (c *DelugeClient) GetListeningPort(ctx context.Context) (int, error) {
+	var ports []int
+	if err := c.call(ctx, "core.get_config_value", &ports, "listen_ports"); err != nil {
+		return 0, err
+	}
+	if len(ports) == 0 {
+		return 0, newAPIError("core.get_config_value", c.rpcURL, http.StatusOK, nil, "listen_ports is empty")
+	}
+	if len(ports) == 2 && ports[1]-ports[0]+1 != c.rangeSize {
+		slog.Info("Deluge listen_ports range does not match PORT_RANGE", "listen_ports", ports, "port_range", c.rangeSize)
+		return 0, nil
+	}
+	return ports[0], nil
+}
+
+// portConfig sets listen_ports to the PORT_RANGE ports starting at
+// port, by default just port itself. With random_port on, Deluge ignores
+// listen_ports entirely, so it is switched off.
+func (c *DelugeClient) portConfig(port int) map[string]any {
+	return map[string]any{"listen_ports": []int{port, port + c.rangeSize - 1}, "random_port": false}
+}
+
+func (c *DelugeClient) SetListeningPort(ctx context.Context, port int) error {
+	return c.call(ctx, "core.set_config_values", nil, c.portConfig(port))
+}
+
+func (c *DelugeClient) ValidateSetPayload(port int) (string, error) {
+	body, err := json.Marshal(c.portConfig(port))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (c *DelugeClient) CountActiveTorrents(ctx context.Context) (int, error) {
+	var torrents map[string]json.RawMessage
+	if err := c.call(ctx, "core.get_torrents_status", &torrents, map[string]string{"state": "Active"}, []string{"name"}); err != nil {
+		return 0, err
+	}
+	return len(torrents), nil
+}
+
+// ConnectionStatus maps Deluge's listen port test onto qBittorrent's terms.
+func (c *DelugeClient) ConnectionStatus(ctx context.Context) (string, error) {
+	var open bool
+	if err := c.call(ctx, "core.test_listen_port", &open); err != nil {
+		return "", err
+	}
+	if open {
+		return "connected", nil
+	}
+	return "firewalled", nil
+}
+
+func (c *DelugeClient) Version(ctx context.Context) (string, error) {
+	var version string
+	if err := c.call(ctx, "daemon.info", &version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (c *DelugeClient) GetPreferencesRaw(ctx context.Context) ([]byte, error) {
+	var prefs json.RawMessage
+	if err := c.call(ctx, "core.get_config", &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (c *DelugeClient) SetPreferencesRaw(ctx context.Context, prefs []byte) error {
+	return c.call(ctx, "core.set_config_values", nil, json.RawMessage(prefs))
+}
+
+func (c *DelugeClient) String() string {
+	return redactURL(c.baseURL)
+}
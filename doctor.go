@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// runDoctor checks the configuration, port source and qBittorrent in turn and
+// prints a report to w, ending in PASS or FAIL for CI smoke tests. It only
+// reads: nothing is ever written to qBittorrent. The return value is the
+// process exit code. It backs --doctor, --check and RUN_MODE=check.
+func runDoctor(w io.Writer, config *Config, configErr error) int {
+	code := doctorChecks(w, config, configErr)
+	if code == 0 {
+		fmt.Fprintln(w, "PASS")
+	} else {
+		fmt.Fprintln(w, "FAIL")
+	}
+	return code
+}
+
+func doctorChecks(w io.Writer, config *Config, configErr error) int {
+	failed := false
+	report := func(ok bool, check, detail string) {
+		mark := " OK "
+		if !ok {
+			mark = "FAIL"
+			failed = true
+		}
+		fmt.Fprintf(w, "[%s] %-22s %s\n", mark, check, redact(detail))
+	}
+	skip := func(check, reason string) {
+		fmt.Fprintf(w, "[SKIP] %-22s %s\n", check, reason)
+	}
+
+	fmt.Fprintln(w, "qBittorrent Port Sync doctor")
+	if configErr != nil {
+		report(false, "configuration", configErr.Error())
+		return 1
+	}
+	report(true, "configuration", "loaded")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Port source
+	filePort := 0
+	if slices.Contains(splitList(config.PortSource, ","), "file") {
+		path, err := resolvePortFile(config.PortFile)
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(path)
+		}
+		if err != nil {
+			report(false, "port file present", err.Error())
+		} else {
+			report(true, "port file present", fmt.Sprintf("%s (%d bytes, modified %s ago)", path, info.Size(), time.Since(info.ModTime()).Round(time.Second)))
+		}
+	}
+	if source, err := newPortSource(config); err != nil {
+		report(false, "port source", err.Error())
+	} else if port, err := source.GetPort(ctx); err != nil {
+		report(false, "port value", err.Error())
+	} else {
+		filePort = port
+		report(true, "port value", fmt.Sprintf("%d from %s", port, source.String()))
+	}
+
+	// qBittorrent
+	client, err := newTorrentClient(config)
+	if err != nil {
+		report(false, "qBittorrent client", err.Error())
+		return 1
+	}
+	if err := client.CheckHealth(ctx); err != nil {
+		report(false, "qBittorrent reachable", err.Error())
+		skip("login", "qBittorrent unreachable")
+		return 1
+	}
+	report(true, "qBittorrent reachable", client.String())
+
+	if err := client.Login(ctx); err != nil {
+		report(false, "login", err.Error())
+		return 1
+	}
+	report(true, "login", "credentials accepted")
+
+	if version, err := client.Version(ctx); err != nil {
+		report(false, "API version", err.Error())
+	} else {
+		report(true, "API version", "qBittorrent "+version)
+	}
+
+	currentPort, err := client.GetListeningPort(ctx)
+	if err != nil {
+		report(false, "current listen port", err.Error())
+		return 1
+	}
+	report(true, "current listen port", fmt.Sprint(currentPort))
+
+	switch {
+	case filePort == 0:
+		skip("change needed", "no forwarded port to compare")
+	case filePort == currentPort:
+		report(true, "change needed", "no, qBittorrent already uses the forwarded port")
+	default:
+		report(true, "change needed", fmt.Sprintf("yes, %d -> %d on the next sync", currentPort, filePort))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
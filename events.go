@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// event is one entry in the recent-activity feed served on /events.
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Port    int       `json:"port,omitempty"`
+}
+
+// eventLog keeps the most recent events in a fixed-size ring.
+type eventLog struct {
+	mu     sync.Mutex
+	events []event
+	next   int
+	full   bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]event, size)}
+}
+
+func (l *eventLog) add(kind, message string, port int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = event{Time: time.Now().UTC(), Kind: kind, Message: redact(message), Port: port}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the logged events, newest first.
+func (l *eventLog) recent() []event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.events)
+	}
+	out := make([]event, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.events[(l.next-i+len(l.events))%len(l.events)])
+	}
+	return out
+}
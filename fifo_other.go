@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func ensureFIFO(path string) error {
+	return errors.New("trigger FIFOs are not supported on this platform")
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func ensureFIFO(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if err := syscall.Mkfifo(path, 0o600); err != nil {
+			return fmt.Errorf("failed to create trigger FIFO: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%s exists and is not a FIFO", path)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// flagValues holds settings given on the command line, keyed by the
+// environment variable they mirror. lookupEnv checks it first, so the order
+// is flag, then environment, then CONFIG_FILE, then the built-in default.
+var flagValues = map[string]string{}
+
+// configFlag is one environment variable exposed as a flag. The flag name is
+// the variable in lower case with dashes: CHECK_INTERVAL is --check-interval.
+type configFlag struct {
+	env     string
+	usage   string
+	boolean bool
+}
+
+var configFlags = []configFlag{
+	{env: "CONFIG_FILE", usage: "read settings from a YAML or TOML `file`"},
+	{env: "CLIENT_TYPE", usage: "torrent client: qbittorrent, transmission or deluge"},
+	{env: "QBITTORRENT_URL", usage: "qBittorrent WebUI URL; comma-separated for several instances, | between addresses of one"},
+	{env: "QBITTORRENT_USERNAME", usage: "qBittorrent WebUI username"},
+	{env: "QBITTORRENT_PASSWORD", usage: "qBittorrent WebUI password (visible in process listings; prefer --password-file)"},
+	{env: "QBITTORRENT_PASSWORD_FILE", usage: "read the qBittorrent password from `file`"},
+	{env: "QBITTORRENT_USERNAME_2", usage: "secondary username, tried when the primary is rejected"},
+	{env: "QBITTORRENT_PASSWORD_2", usage: "secondary password"},
+	{env: "QBITTORRENT_PASSWORD_2_FILE", usage: "read the secondary password from `file`"},
+	{env: "QBITTORRENT_TLS_INSECURE", usage: "skip TLS certificate verification", boolean: true},
+	{env: "QBITTORRENT_CA_FILE", usage: "trust the CA certificates in `file`"},
+	{env: "AUTH_MODE", usage: "cookie to log in, or header to send AUTH_HEADER_NAME with every request instead"},
+	{env: "AUTH_HEADER_NAME", usage: "header a trusted reverse proxy authenticates, for AUTH_MODE=header"},
+	{env: "AUTH_HEADER_VALUE", usage: "value of AUTH_HEADER_NAME"},
+	{env: "AUTH_HEADER_VALUE_FILE", usage: "read AUTH_HEADER_VALUE from `file`"},
+	{env: "QBITTORRENT_PROXY", usage: "http, https or socks5 proxy URL for reaching the client; overrides HTTP_PROXY and HTTPS_PROXY"},
+	{env: "QB_LOGIN_PATH", usage: "login endpoint path"},
+	{env: "QB_PREFERENCES_PATH", usage: "preferences endpoint path"},
+	{env: "QB_SET_PREFERENCES_PATH", usage: "set-preferences endpoint path"},
+	{env: "QB_PROFILE", usage: "profile field sent with setPreferences, for forks that route on it"},
+	{env: "FORCE_STATIC_PORT", usage: "also turn off qBittorrent's random port when setting the port", boolean: true},
+	{env: "LISTEN_PORT_KEY", usage: "qBittorrent preference `key` holding the listening port, for forks that rename listen_port"},
+	{env: "EXTRA_PREFERENCES", usage: "JSON object of qBittorrent preferences sent with every port change"},
+	{env: "SESSION_FILE", usage: "persist the qBittorrent session in `file`"},
+	{env: "TRANSMISSION_URL", usage: "Transmission RPC URL"},
+	{env: "TRANSMISSION_USERNAME", usage: "Transmission RPC username"},
+	{env: "TRANSMISSION_PASSWORD", usage: "Transmission RPC password"},
+	{env: "TRANSMISSION_PASSWORD_FILE", usage: "read the Transmission password from `file`"},
+	{env: "DELUGE_URL", usage: "Deluge Web UI URL"},
+	{env: "DELUGE_PASSWORD", usage: "Deluge Web UI password"},
+	{env: "DELUGE_PASSWORD_FILE", usage: "read the Deluge password from `file`"},
+
+	{env: "PORT_SOURCE", usage: "port sources in priority order: file, exec, gluetun-api"},
+	{env: "PORT_FILE", usage: "forwarded port `file` written by the VPN client; a comma-separated list or glob is allowed"},
+	{env: "PORT_FILE_SELECT", usage: "with several port files: first-existing, or specific for one file per QBITTORRENT_URL instance"},
+	{env: "PORT_FILE_MAX_AGE", usage: "treat the port file as stale after this `duration`"},
+	{env: "PORT_FILE_PARSE", usage: "port file parsing: strict or lenient"},
+	{env: "PORT_FILE_SENTINELS", usage: "comma-separated values meaning no port is forwarded"},
+	{env: "PORT_FILE_FORMAT", usage: "port file format: auto, plain, json or keyvalue"},
+	{env: "PORT_JSON_FIELD", usage: "dotted JSON path, or key=value key, of the port in the port file (default port)"},
+	{env: "USE_FILE_LOCK", usage: "take a shared lock while reading the port file", boolean: true},
+	{env: "WATCH_MODE", usage: "react to port file changes: watch or poll"},
+	{env: "FILE_WAIT_TIMEOUT", usage: "how long startup waits for a port before reporting an error; 30s for a one-shot run, otherwise only READY_TIMEOUT applies"},
+	{env: "FILE_WAIT_FAIL", usage: "exit non-zero when FILE_WAIT_TIMEOUT passes without a port, instead of logging and waiting on", boolean: true},
+	{env: "FILE_WAIT_INTERVAL", usage: "how often to poll for the port at startup; defaults to the retry backoff"},
+	{env: "PORT_CMD", usage: "command printing the port, for the exec source"},
+	{env: "PORT_CMD_TIMEOUT", usage: "timeout for PORT_CMD"},
+	{env: "PORT_OFFSET", usage: "added to the forwarded port to get the listen port"},
+	{env: "PORT_RANGE", usage: "number of contiguous ports from the listen port; Deluge listens on all of them"},
+	{env: "GLUETUN_API_URL", usage: "gluetun control server port-forward URL"},
+	{env: "GLUETUN_API_KEY", usage: "gluetun control server API key"},
+	{env: "GLUETUN_API_KEY_FILE", usage: "read the gluetun API key from `file`"},
+	{env: "GLUETUN_RETRIES", usage: "retries while gluetun reconnects"},
+	{env: "GLUETUN_RETRY_DELAY", usage: "first delay between gluetun retries"},
+	{env: "GLUETUN_RETRY_MAX_DELAY", usage: "longest delay between gluetun retries"},
+
+	{env: "RUN_MODE", usage: "daemon, oneshot to sync once and exit, or check to run the --check report and exit"},
+	{env: "CHECK_INTERVAL", usage: "seconds between checks"},
+	{env: "MIN_CHECK_INTERVAL", usage: "lowest CHECK_INTERVAL accepted"},
+	{env: "SCHEDULER", usage: "check scheduling: monotonic or ticker"},
+	{env: "APPLY_DELAY", usage: "wait this long after a port change and apply it only if still unchanged"},
+	{env: "APPLY_WHEN", usage: "when to apply changes: always, has_active or no_active"},
+	{env: "ALWAYS_VERIFY", usage: "compare against qBittorrent on every check", boolean: true},
+	{env: "FORCE_WRITE_ON_START", usage: "write the port on startup even if it is already set", boolean: true},
+	{env: "DRY_RUN", usage: "log port changes without making them", boolean: true},
+	{env: "DRY_RUN_FULL", usage: "like --dry-run, also validating the request payload", boolean: true},
+	{env: "CONFIRM_BIND", usage: "wait for qBittorrent to report the new port as connected", boolean: true},
+	{env: "CONFIRM_BIND_TIMEOUT", usage: "how long to wait for CONFIRM_BIND"},
+	{env: "CHECK_QB_HEALTH_BEFORE_SET", usage: "check qBittorrent responds before changing the port", boolean: true},
+	{env: "PREFLIGHT_AUTH_CHECK", usage: "check the session before requests after an idle period", boolean: true},
+	{env: "FOLLOW_LOGIN_REDIRECTS", usage: "follow redirects on login", boolean: true},
+	{env: "SYNC_TIMEOUT", usage: "bound on a single sync cycle"},
+	{env: "STACK_DOWN_MAX_BACKOFF", usage: "longest backoff while the whole stack is down"},
+	{env: "DNS_MAX_BACKOFF", usage: "longest backoff while the qBittorrent host does not resolve"},
+	{env: "BREAKER_THRESHOLD", usage: "failed cycles in a row before checking qBittorrent only every BREAKER_INTERVAL; 0 disables"},
+	{env: "BREAKER_INTERVAL", usage: "how often to probe qBittorrent while the circuit breaker is open"},
+	{env: "READY_TIMEOUT", usage: "how long to wait for qBittorrent and the port at startup; 0 waits forever, the daemon default"},
+	{env: "WAIT_FOR_URLS", usage: "comma-separated URLs that must answer 2xx before starting"},
+	{env: "WAIT_FOR_TIMEOUT", usage: "how long to wait for WAIT_FOR_URLS"},
+	{env: "INITIAL_STABLE_READS", usage: "identical port reads required before the first sync"},
+	{env: "INITIAL_READ_INTERVAL", usage: "delay between initial port reads"},
+	{env: "SYNC_ON_SHUTDOWN", usage: "run a final sync before exiting", boolean: true},
+	{env: "SHUTDOWN_TIMEOUT", usage: "grace period for shutdown"},
+
+	{env: "MAX_RETRIES", usage: "retries for transient request failures"},
+	{env: "RETRY_BASE_DELAY", usage: "first retry delay"},
+	{env: "RETRY_MAX_DELAY", usage: "longest retry delay"},
+	{env: "RATE_LIMIT_RETRIES", usage: "retries after the WebUI rate-limits a request"},
+	{env: "RATE_LIMIT_MAX_WAIT", usage: "longest wait for a rate limit to clear"},
+	{env: "LOGIN_COOLDOWN", usage: "wait at least this long to log in again after a rejected login"},
+	{env: "LOGIN_MAX_FAILURES", usage: "rejected logins in a row before pausing for LOGIN_LOCKOUT"},
+	{env: "LOGIN_LOCKOUT", usage: "pause after LOGIN_MAX_FAILURES rejected logins"},
+	{env: "REQUEST_TIMEOUT", usage: "timeout for each HTTP request"},
+	{env: "HTTP_TRANSPORT", usage: "connection pooling: shared or per_instance"},
+	{env: "HTTP_MAX_CONNS_PER_HOST", usage: "connection limit per host"},
+	{env: "HTTP_MAX_IDLE_CONNS", usage: "idle connection limit"},
+	{env: "STARTUP_CONCURRENCY", usage: "parallel logins across endpoints"},
+
+	{env: "ON_CHANGE_CMD", usage: "shell command run when the port changes"},
+	{env: "ON_CHANGE_URL", usage: "URL POSTed to when the port changes"},
+	{env: "HOOK_TIMEOUT", usage: "timeout for change hooks"},
+	{env: "NOTIFY_URL", usage: "notification URL for port changes"},
+	{env: "NOTIFY_TYPE", usage: "notification format: ntfy, gotify, discord or generic"},
+	{env: "EVENT_SINK", usage: "event sink: file, webhook, nats or redis"},
+	{env: "EVENT_SINK_URL", usage: "event sink address"},
+	{env: "EVENT_SINK_TOPIC", usage: "event sink subject or channel"},
+	{env: "REPORT_FILE", usage: "write a JSON report of each change to `file`"},
+
+	{env: "CONTROL_ADDR", usage: "listen address for the control API and dashboard"},
+	{env: "STATUS_ADDR", usage: "listen address for a read-only /status"},
+	{env: "HEALTH_ADDR", usage: "listen address for /healthz and /readyz"},
+	{env: "METRICS_ADDR", usage: "listen address for /metrics"},
+	{env: "METRICS_TEXTFILE", usage: "write metrics for node_exporter to `file`"},
+	{env: "TRIGGER_FIFO", usage: "named pipe that triggers a sync when written to"},
+	{env: "HEARTBEAT_INTERVAL", usage: "log a summary this often"},
+	{env: "AUTH_HEALTH_INTERVAL", usage: "check the session this often"},
+	{env: "WATCHDOG_MAX_FAILURES", usage: "failed checks in a row before systemd watchdog pings stop"},
+	{env: "BANNER_QUIET_PERIOD", usage: "suppress repeated configuration banners within this period"},
+
+	{env: "LOG_FORMAT", usage: "log format: text or json"},
+	{env: "LOG_LEVEL", usage: "log level: debug, info, warn or error"},
+	{env: "SINGLE_LINE_LOGS", usage: "escape line breaks inside log values", boolean: true},
+	{env: "REDACT_KEYS", usage: "comma-separated patterns of variables to redact"},
+	{env: "STRICT_CONFIG", usage: "fail on out-of-range settings instead of clamping them", boolean: true},
+}
+
+// flagAliases are shorter names for the flags people type most.
+var flagAliases = map[string]string{
+	"url":           "QBITTORRENT_URL",
+	"username":      "QBITTORRENT_USERNAME",
+	"password":      "QBITTORRENT_PASSWORD",
+	"password-file": "QBITTORRENT_PASSWORD_FILE",
+}
+
+// envFlag stores a flag's value under its environment variable name.
+type envFlag struct {
+	env     string
+	boolean bool
+}
+
+func (f *envFlag) String() string { return "" }
+
+func (f *envFlag) Set(value string) error {
+	flagValues[f.env] = value
+	return nil
+}
+
+func (f *envFlag) IsBoolFlag() bool { return f.boolean }
+
+func flagName(env string) string {
+	return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// registerConfigFlags adds a flag for every setting, plus the aliases and
+// --version, to fs.
+func registerConfigFlags(fs *flag.FlagSet) (showVersion *bool) {
+	byEnv := make(map[string]*envFlag, len(configFlags))
+	for _, cf := range configFlags {
+		f := &envFlag{env: cf.env, boolean: cf.boolean}
+		byEnv[cf.env] = f
+		fs.Var(f, flagName(cf.env), cf.usage+" ("+cf.env+")")
+	}
+	for alias, env := range flagAliases {
+		fs.Var(byEnv[env], alias, "alias for --"+flagName(env))
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\nKeeps a torrent client's listening port in sync with the VPN's forwarded port.\nEvery flag can also be set with the environment variable in parentheses;\nflags take precedence over the environment, which takes precedence over CONFIG_FILE.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	return fs.Bool("version", false, "print the version and exit")
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// readFileShared falls back to a plain read where flock is unavailable.
+func readFileShared(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errVPNReconnecting marks gluetun responses that are normal while the tunnel
+// is being re-established: a 5xx from the control server, or port 0.
+var errVPNReconnecting = errors.New("VPN reconnecting")
+
+// gluetunPortSource reads the forwarded port from gluetun's control server.
+// Reconnect-state responses are retried with backoff inside a single sync;
+// anything else (auth, 404, bad JSON, gluetun unreachable) is returned at once.
+type gluetunPortSource struct {
+	url           string
+	apiKey        string
+	client        *http.Client
+	retries       int
+	retryDelay    time.Duration
+	retryMaxDelay time.Duration
+	reconnecting  bool
+	clock         clock
+}
+
+func newGluetunPortSource(config *Config) *gluetunPortSource {
+	return &gluetunPortSource{
+		url:           config.GluetunAPIURL,
+		apiKey:        config.GluetunAPIKey,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		retries:       config.GluetunRetries,
+		retryDelay:    config.GluetunRetryDelay,
+		retryMaxDelay: config.GluetunRetryMaxDelay,
+		clock:         realClock{},
+	}
+}
+
+func (s *gluetunPortSource) GetPort(ctx context.Context) (int, error) {
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		port, err := s.getPortFromGluetun(ctx)
+		if err == nil {
+			if s.reconnecting {
+				slog.Info("VPN reconnected", "port", port)
+				s.reconnecting = false
+			}
+			return port, nil
+		}
+		if !errors.Is(err, errVPNReconnecting) {
+			return 0, err
+		}
+		if !s.reconnecting {
+			slog.Info("VPN reconnecting, waiting for gluetun to forward a port", "detail", err)
+			s.reconnecting = true
+		}
+		if attempt >= s.retries {
+			// Still reconnecting: report no port rather than an error so
+			// the sync loop waits quietly for the next cycle.
+			return 0, fmt.Errorf("%w: %v", ErrNoPort, err)
+		}
+
+		slog.Debug("Retrying gluetun port request", "attempt", attempt+1, "delay", delay, "detail", err)
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%w: %v", ErrNoPort, err)
+		case <-s.clock.After(delay):
+		}
+		delay = min(delay*2, s.retryMaxDelay)
+	}
+}
+
+func (s *gluetunPortSource) getPortFromGluetun(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, fmt.Errorf("gluetun request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return 0, fmt.Errorf("reading gluetun response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		return 0, fmt.Errorf("%w (status %d)", errVPNReconnecting, resp.StatusCode)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return 0, fmt.Errorf("gluetun rejected the request (status %d); check GLUETUN_API_KEY", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return 0, fmt.Errorf("gluetun returned status %d: %s", resp.StatusCode, truncate(strings.TrimSpace(string(body)), 512))
+	}
+
+	var result struct {
+		Port *int `json:"port"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Port == nil {
+		return 0, fmt.Errorf("unexpected gluetun response: %s", truncate(strings.TrimSpace(string(body)), 512))
+	}
+	if *result.Port == 0 {
+		return 0, fmt.Errorf("%w (no port forwarded yet)", errVPNReconnecting)
+	}
+	if *result.Port < 1 || *result.Port > 65535 {
+		return 0, fmt.Errorf("gluetun reported invalid port %d", *result.Port)
+	}
+	return *result.Port, nil
+}
+
+func (s *gluetunPortSource) String() string {
+	return "gluetun " + redactURL(s.url)
+}
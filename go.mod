@@ -1,3 +1,11 @@
 module qbittorrent-port-sync
 
 go 1.21
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/fsnotify/fsnotify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Error categories reported by /healthz.
+const (
+	categoryAuth        = "auth"
+	categoryNetwork     = "network"
+	categoryFile        = "file"
+	categoryQBittorrent = "qbittorrent"
+	categoryStale       = "stale"
+)
+
+// healthState backs the probe endpoints served on HEALTH_ADDR.
+type healthState struct {
+	ready atomic.Bool
+
+	// staleAfter is how long /healthz tolerates no completed sync cycle,
+	// which catches a wedged loop that would never record an error.
+	staleAfter atomic.Int64 // nanoseconds; changes on SIGHUP reload
+	lastSync   atomic.Int64 // unix nanoseconds
+
+	mu      sync.Mutex
+	lastErr *healthError
+}
+
+type healthError struct {
+	Message  string    `json:"message"`
+	Category string    `json:"category"`
+	Time     time.Time `json:"time"`
+}
+
+// recordError marks the service unhealthy until the next recordSuccess.
+func (h *healthState) recordError(category string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = &healthError{Message: redact(err.Error()), Category: category, Time: time.Now().UTC()}
+}
+
+func (h *healthState) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = nil
+}
+
+func (h *healthState) recordSync() {
+	h.lastSync.Store(time.Now().UnixNano())
+}
+
+func (h *healthState) lastError() *healthError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastErr
+}
+
+func (h *healthState) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// handleHealthz reports 503 while the most recent sync failed, or once no
+// sync has completed for staleAfter. Probes only need the status code; the
+// JSON body is for humans.
+func (h *healthState) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	lastErr := h.lastError()
+	staleAfter := time.Duration(h.staleAfter.Load())
+	if last := h.lastSync.Load(); lastErr == nil && last != 0 && staleAfter > 0 {
+		if age := time.Since(time.Unix(0, last)); age > staleAfter {
+			lastErr = &healthError{
+				Message:  fmt.Sprintf("no sync completed in %v (limit %v)", age.Round(time.Second), staleAfter),
+				Category: categoryStale,
+				Time:     time.Unix(0, last).UTC(),
+			}
+		}
+	}
+	if lastErr == nil {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(struct {
+		Status    string       `json:"status"`
+		LastError *healthError `json:"last_error"`
+	}{"unhealthy", lastErr})
+}
+
+// classifyError buckets a qBittorrent client error for /healthz. Port source
+// errors are recorded as categoryFile by the caller.
+func classifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrLoginBanned) || errors.Is(err, ErrLoginCooldown) ||
+		errors.Is(err, ErrAuthExpired):
+		return categoryAuth
+	case errors.Is(err, ErrClientUnreachable) || errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded):
+		return categoryNetwork
+	default:
+		return categoryQBittorrent
+	}
+}
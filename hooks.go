@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// changeHook is told about every new forwarded port, independently of
+// qBittorrent, so the port can also be opened in a firewall, announced to
+// another service, and so on.
+type changeHook interface {
+	Run(ctx context.Context, port, previousPort int) error
+	String() string
+}
+
+// cmdHook runs ON_CHANGE_CMD through /bin/sh with PORT and PREVIOUS_PORT set
+// in its environment.
+type cmdHook struct {
+	command string
+	timeout time.Duration
+}
+
+func (h *cmdHook) Run(ctx context.Context, port, previousPort int) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Env = append(os.Environ(), "PORT="+strconv.Itoa(port), "PREVIOUS_PORT="+strconv.Itoa(previousPort))
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("hook command timed out after %v", h.timeout)
+		}
+		return fmt.Errorf("hook command failed (%v): %s", err, truncate(strings.TrimSpace(stderr.String()), 512))
+	}
+	return nil
+}
+
+func (h *cmdHook) String() string {
+	return "command " + h.command
+}
+
+// webhook POSTs {"port": N, "previous_port": M} to ON_CHANGE_URL. Any 2xx
+// response counts as delivered.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (h *webhook) Run(ctx context.Context, port, previousPort int) error {
+	body, err := json.Marshal(map[string]int{"port": port, "previous_port": previousPort})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		// *url.Error repeats the full URL, which may carry a token.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (h *webhook) String() string {
+	return "webhook " + redactURL(h.url)
+}
+
+func newChangeHooks(config *Config) []changeHook {
+	var hooks []changeHook
+	if config.OnChangeCmd != "" {
+		hooks = append(hooks, &cmdHook{command: config.OnChangeCmd, timeout: config.HookTimeout})
+	}
+	if config.OnChangeURL != "" {
+		hooks = append(hooks, &webhook{url: config.OnChangeURL, client: &http.Client{Timeout: config.HookTimeout}})
+	}
+	return hooks
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Values for LOG_FORMAT.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging installs the default logger, writing to w.
+func setupLogging(w io.Writer) {
+	format := strings.ToLower(getEnv("LOG_FORMAT", logFormatText))
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info")))
+
+	// SINGLE_LINE_LOGS escapes line breaks inside values ourselves, so no
+	// entry can span lines whatever handler or collector sits downstream.
+	// JSON output escapes them already.
+	singleLine := getEnvBool("SINGLE_LINE_LOGS", false) && format != logFormatJSON
+	clean := func(s string) string {
+		s = redact(s)
+		if singleLine {
+			s = lineBreaks.Replace(s)
+		}
+		return s
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Keep source as file:line, like the old log.Lshortfile output.
+			if a.Key == slog.SourceKey {
+				if src, ok := a.Value.Any().(*slog.Source); ok {
+					a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+				return a
+			}
+			switch v := a.Value.Any().(type) {
+			case string:
+				a.Value = slog.StringValue(clean(v))
+			case error:
+				a.Value = slog.StringValue(clean(v.Error()))
+			}
+			return a
+		},
+	}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if format == logFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if format != logFormatText && format != logFormatJSON {
+		slog.Warn("Unknown LOG_FORMAT, using text", "log_format", format)
+	}
+	if levelErr != nil {
+		slog.Warn("Unknown LOG_LEVEL, using info", "log_level", getEnv("LOG_LEVEL", ""))
+	}
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+
+// errAttrs returns the error plus, for qBittorrent API failures, the
+// operation, URL and status code as separate fields.
+func errAttrs(err error) []any {
+	attrs := []any{"error", err}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		attrs = append(attrs, "operation", apiErr.Operation, "url", apiErr.URL)
+		if apiErr.StatusCode != 0 {
+			attrs = append(attrs, "status_code", apiErr.StatusCode)
+		}
+	}
+	return attrs
+}
+
+// fatal logs at error level, attributed to the caller, and exits.
+func fatal(msg string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	_ = slog.Default().Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	// ErrLoginBanned means qBittorrent answered the login with 403, which it
+	// does once an IP has failed to log in too many times.
+	ErrLoginBanned = errors.New("banned by qBittorrent")
+	// ErrLoginCooldown means a login was not attempted because recent
+	// attempts failed.
+	ErrLoginCooldown = errors.New("login cooling down")
+)
+
+// loginGuard keeps failed logins under qBittorrent's ban threshold (5
+// failures by default, after which the IP is banned for an hour). After a
+// rejected login the next attempt waits LOGIN_COOLDOWN; after
+// LOGIN_MAX_FAILURES in a row it waits LOGIN_LOCKOUT, since by then the
+// credentials are almost certainly wrong. Transport errors never reach
+// qBittorrent's counter and are not counted here either.
+type loginGuard struct {
+	cooldown    time.Duration
+	maxFailures int
+	lockout     time.Duration
+
+	failures    int
+	lastFailure time.Time
+}
+
+func newLoginGuard(config *Config) *loginGuard {
+	return &loginGuard{
+		cooldown:    config.LoginCooldown,
+		maxFailures: config.LoginMaxFailures,
+		lockout:     config.LoginLockout,
+	}
+}
+
+// check returns ErrLoginCooldown while the next attempt has to wait.
+func (g *loginGuard) check(now time.Time) error {
+	if g.failures == 0 {
+		return nil
+	}
+	wait := g.cooldown
+	if g.failures >= g.maxFailures {
+		wait = g.lockout
+	}
+	if next := g.lastFailure.Add(wait); now.Before(next) {
+		return fmt.Errorf("%w after %d failed logins, next attempt at %s", ErrLoginCooldown, g.failures, next.Format(time.TimeOnly))
+	}
+	return nil
+}
+
+// failed records n rejected attempts.
+func (g *loginGuard) failed(n int, now time.Time) {
+	before := g.failures
+	g.failures += n
+	g.lastFailure = now
+	if before < g.maxFailures && g.failures >= g.maxFailures {
+		slog.Error("qBittorrent rejected too many logins in a row: the credentials are likely wrong or this IP is banned; pausing login attempts",
+			"failures", g.failures, "retry_in", g.lockout)
+	}
+}
+
+func (g *loginGuard) succeeded() {
+	if g.failures >= g.maxFailures {
+		slog.Info("Login succeeded again after repeated failures", "failures", g.failures)
+	}
+	g.failures = 0
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the sync loop's logging out of test and benchmark output
+// unless -v is given.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeQBittorrent is a minimal qBittorrent WebUI: one password, one session
+// at a time and a preferences document that setPreferences merges into.
+type fakeQBittorrent struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	password string
+	sid      string
+	logins   int
+	prefs    map[string]any
+	sets     []map[string]any
+	// setReply is the body of every setPreferences response. Anything but
+	// "" or "Ok." is a rejection, and the preferences are left alone.
+	setReply string
+	// headerName and headerValue, when set, replace the session cookie,
+	// as an authenticating reverse proxy does for AUTH_MODE=header.
+	headerName, headerValue string
+	// prefsBody, when set, is served as the preferences document verbatim.
+	prefsBody string
+}
+
+func newFakeQBittorrent(t testing.TB) *fakeQBittorrent {
+	t.Helper()
+	f := newUnstartedFakeQBittorrent(t)
+	f.Start()
+	return f
+}
+
+// newUnstartedFakeQBittorrent lets the caller choose Start or StartTLS.
+func newUnstartedFakeQBittorrent(t testing.TB) *fakeQBittorrent {
+	t.Helper()
+	f := &fakeQBittorrent{
+		password: "secret",
+		prefs:    map[string]any{"listen_port": float64(6881), "random_port": false, "upnp": true},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/auth/login", f.handleLogin)
+	mux.HandleFunc("/api/v2/app/version", f.authed(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "v4.6.0")
+	}))
+	mux.HandleFunc("/api/v2/app/webapiVersion", f.authed(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "2.9.3")
+	}))
+	mux.HandleFunc("/api/v2/app/preferences", f.authed(f.handlePreferences))
+	mux.HandleFunc("/api/v2/app/setPreferences", f.authed(f.handleSetPreferences))
+	f.Server = httptest.NewUnstartedServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeQBittorrent) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.PostFormValue("password") != f.password {
+		fmt.Fprint(w, "Fails.")
+		return
+	}
+	f.logins++
+	f.sid = fmt.Sprintf("sid-%d", f.logins)
+	http.SetCookie(w, &http.Cookie{Name: "SID", Value: f.sid, Path: "/"})
+	fmt.Fprint(w, "Ok.")
+}
+
+// authed answers 403 unless the request carries the current session, or the
+// auth header when one is configured.
+func (f *fakeQBittorrent) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("SID")
+		f.mu.Lock()
+		ok := err == nil && f.sid != "" && cookie.Value == f.sid
+		if f.headerName != "" {
+			ok = r.Header.Get(f.headerName) == f.headerValue
+		}
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (f *fakeQBittorrent) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.prefsBody != "" {
+		fmt.Fprint(w, f.prefsBody)
+		return
+	}
+	json.NewEncoder(w).Encode(f.prefs)
+}
+
+func (f *fakeQBittorrent) handleSetPreferences(w http.ResponseWriter, r *http.Request) {
+	var prefs map[string]any
+	if err := json.Unmarshal([]byte(r.PostFormValue("json")), &prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprint(w, f.setReply)
+	if f.setReply != "" && f.setReply != "Ok." {
+		return
+	}
+	f.sets = append(f.sets, prefs)
+	for k, v := range prefs {
+		f.prefs[k] = v
+	}
+}
+
+// expireSession makes qBittorrent forget the session, as it does after the
+// WebUI session timeout.
+func (f *fakeQBittorrent) expireSession() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sid = ""
+}
+
+func (f *fakeQBittorrent) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins
+}
+
+func (f *fakeQBittorrent) listenPort() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	port, _ := f.prefs["listen_port"].(float64)
+	return int(port)
+}
+
+// testConfig loads the configuration from env on top of the settings every
+// test needs: the fake's URL and password and no retries.
+func testConfig(t testing.TB, qbURL string, env map[string]string) *Config {
+	t.Helper()
+	t.Setenv("QBITTORRENT_URL", qbURL)
+	t.Setenv("QBITTORRENT_PASSWORD", "secret")
+	t.Setenv("MAX_RETRIES", "0")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return config
+}
+
+func newTestClient(t testing.TB, config *Config) *QBittorrentClient {
+	t.Helper()
+	client, err := NewQBittorrentClient(config.QBittorrentURL, newTransport(config), config)
+	if err != nil {
+		t.Fatalf("NewQBittorrentClient: %v", err)
+	}
+	return client
+}
+
+func TestLoginBodyIs(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+		ok   bool
+	}{
+		{"Ok.", "ok", true},
+		{"ok.", "ok", true},
+		{"Ok. ", "ok", true},
+		{"Ok", "ok", true},
+		{"Fails.", "ok", false},
+		{"Fails.", "fails", true},
+		{"", "ok", false},
+		{"Ok..", "ok", false},
+	}
+	for _, tt := range tests {
+		if got := loginBodyIs(tt.body, tt.want); got != tt.ok {
+			t.Errorf("loginBodyIs(%q, %q) = %v, want %v", tt.body, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	client := newTestClient(t, testConfig(t, qb.URL, nil))
+
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if got := qb.loginCount(); got != 1 {
+		t.Errorf("logins = %d, want 1", got)
+	}
+	if client.apiVersion != "2.9.3" {
+		t.Errorf("apiVersion = %q, want 2.9.3", client.apiVersion)
+	}
+}
+
+func TestLoginRejectedCredentials(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	qb.password = "other"
+	client := newTestClient(t, testConfig(t, qb.URL, nil))
+
+	err := client.Login(context.Background())
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login error = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestPreferencesRoundTrip(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	client := newTestClient(t, testConfig(t, qb.URL, map[string]string{"EXTRA_PREFERENCES": `{"upnp": false}`}))
+	ctx := context.Background()
+	if err := client.Login(ctx); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	port, err := client.GetListeningPort(ctx)
+	if err != nil || port != 6881 {
+		t.Fatalf("GetListeningPort = %d, %v; want 6881", port, err)
+	}
+	if err := client.SetListeningPort(ctx, 51413); err != nil {
+		t.Fatalf("SetListeningPort: %v", err)
+	}
+	port, err = client.GetListeningPort(ctx)
+	if err != nil || port != 51413 {
+		t.Fatalf("GetListeningPort after set = %d, %v; want 51413", port, err)
+	}
+
+	if len(qb.sets) != 1 {
+		t.Fatalf("setPreferences calls = %d, want 1", len(qb.sets))
+	}
+	if upnp, ok := qb.sets[0]["upnp"].(bool); !ok || upnp {
+		t.Errorf("setPreferences payload %v does not carry EXTRA_PREFERENCES upnp=false", qb.sets[0])
+	}
+}
+
+func TestExpiredSessionIsReported(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	client := newTestClient(t, testConfig(t, qb.URL, nil))
+	ctx := context.Background()
+	if err := client.Login(ctx); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	qb.expireSession()
+	if _, err := client.GetListeningPort(ctx); !errors.Is(err, ErrAuthExpired) {
+		t.Fatalf("GetListeningPort error = %v, want ErrAuthExpired", err)
+	}
+	if err := client.SetListeningPort(ctx, 51413); !errors.Is(err, ErrAuthExpired) {
+		t.Fatalf("SetListeningPort error = %v, want ErrAuthExpired", err)
+	}
+}
+
+func TestGetListeningPortRejectsBadPreferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"malformed JSON", `{"listen_port": 6881, "upnp": tr`, "failed to decode preferences"},
+		{"not an object", `[6881]`, "failed to decode preferences"},
+		{"missing listen_port", `{"random_port": false, "upnp": true}`, "listen_port not found in preferences"},
+		{"renamed key", `{"session_port": 6881, "upnp": true}`, "set LISTEN_PORT_KEY to one of: session_port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := newFakeQBittorrent(t)
+			qb.prefsBody = tt.body
+			client := newTestClient(t, testConfig(t, qb.URL, nil))
+			ctx := context.Background()
+			if err := client.Login(ctx); err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+
+			port, err := client.GetListeningPort(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("GetListeningPort = %d, %v; want an error mentioning %q", port, err, tt.wantErr)
+			}
+			if port != 0 {
+				t.Errorf("GetListeningPort returned port %d alongside the error", port)
+			}
+		})
+	}
+}
+
+func TestParsePortString(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		mode    string
+		want    int
+		wantErr bool
+	}{
+		{"single line", "51413", parseStrict, 51413, false},
+		{"trailing newline", "51413\n", parseStrict, 51413, false},
+		{"trailing whitespace", "51413  \t\n", parseStrict, 51413, false},
+		{"surrounding blank lines", "\n\n51413\n\n", parseStrict, 51413, false},
+		{"strict rejects extra lines", "51413\nconnected\n", parseStrict, 0, true},
+		{"lenient takes the first line", "51413\nconnected\n", parseLenient, 51413, false},
+		{"lenient skips blank lines", "\n\n  \n51413\n", parseLenient, 51413, false},
+		{"lenient skips comments", "# written by gluetun\n# status: ok\n51413\n", parseLenient, 51413, false},
+		{"lenient ignores trailing tokens", "51413   up since 12:00\n", parseLenient, 51413, false},
+		{"lenient with CRLF", "# port\r\n51413\r\n", parseLenient, 51413, false},
+		{"lenient without a port", "# status: down\n\n", parseLenient, 0, true},
+		{"out of range", "70000\n", parseLenient, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePort([]byte(tt.content), portFormat{format: formatPlain, mode: tt.mode})
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parsePort(%q, %s) = %d, %v; want %d, error %v", tt.content, tt.mode, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func benchmarkParsePort(b *testing.B, content string, format portFormat) {
+	data := []byte(content)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parsePort(data, format); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParsePortPlain(b *testing.B) {
+	benchmarkParsePort(b, "51413\n", portFormat{format: formatAuto, mode: parseStrict})
+}
+
+func BenchmarkParsePortLenient(b *testing.B) {
+	benchmarkParsePort(b, "# written by gluetun\n\n51413 up\n", portFormat{format: formatAuto, mode: parseLenient})
+}
+
+func BenchmarkParsePortJSON(b *testing.B) {
+	benchmarkParsePort(b, `{"port": 51413}`, portFormat{format: formatAuto, mode: parseStrict})
+}
+
+func BenchmarkParsePortKeyValue(b *testing.B) {
+	benchmarkParsePort(b, "# vpn\nexport PORT=51413\n", portFormat{format: formatAuto, mode: parseStrict})
+}
+
+// padPreferences adds filler until the fake's preferences are about the size
+// of a stock qBittorrent 4.6 document, roughly 200 keys of mixed types, so
+// benchmarks pay a realistic decoding cost.
+func padPreferences(qb *fakeQBittorrent) {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("filler_%03d", i)
+		switch i % 3 {
+		case 0:
+			qb.prefs[key] = i%2 == 0
+		case 1:
+			qb.prefs[key] = float64(i * 1000)
+		default:
+			qb.prefs[key] = "/downloads/incomplete/" + key
+		}
+	}
+}
+
+func BenchmarkGetListeningPort(b *testing.B) {
+	qb := newFakeQBittorrent(b)
+	padPreferences(qb)
+	client := newTestClient(b, testConfig(b, qb.URL, nil))
+	ctx := context.Background()
+	if err := client.Login(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.GetListeningPort(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetListeningPort(b *testing.B) {
+	qb := newFakeQBittorrent(b)
+	client := newTestClient(b, testConfig(b, qb.URL, nil))
+	ctx := context.Background()
+	if err := client.Login(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.SetListeningPort(ctx, 51413); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"5", 5 * time.Second, true},
+		{" 0 ", 0, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// rateLimitedServer answers 429 with retryAfter for the first limited
+// requests, then serves the preferences.
+func rateLimitedServer(t *testing.T, limited int, retryAfter func() string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= limited {
+			w.Header().Set("Retry-After", retryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"listen_port": 51413}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestRateLimitHonorsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+	}{
+		{"seconds", func() string { return "3600" }},
+		{"HTTP date", func() string { return time.Now().Add(time.Hour).UTC().Format(http.TimeFormat) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := rateLimitedServer(t, 1, tt.retryAfter)
+			// RATE_LIMIT_MAX_WAIT caps the hour qBittorrent asks for.
+			client := newTestClient(t, testConfig(t, srv.URL, map[string]string{"RATE_LIMIT_MAX_WAIT": "20ms"}))
+
+			start := time.Now()
+			port, err := client.GetListeningPort(context.Background())
+			if err != nil || port != 51413 {
+				t.Fatalf("GetListeningPort = %d, %v; want 51413", port, err)
+			}
+			if got := requests.Load(); got != 2 {
+				t.Errorf("requests = %d, want 2", got)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("waited %v, RATE_LIMIT_MAX_WAIT did not cap Retry-After", elapsed)
+			}
+		})
+	}
+}
+
+func TestRateLimitWaitsOnTheClientClock(t *testing.T) {
+	clk := newFakeClock()
+	tests := []struct {
+		name       string
+		retryAfter func() string
+	}{
+		{"seconds", func() string { return "30" }},
+		// An HTTP date is measured against the client's clock, not the
+		// wall clock, so this is 30s away rather than long past.
+		{"HTTP date", func() string { return clk.Now().Add(30 * time.Second).Format(http.TimeFormat) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := rateLimitedServer(t, 1, tt.retryAfter)
+			client := newTestClient(t, testConfig(t, srv.URL, nil))
+			client.clock = clk
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := client.GetListeningPort(context.Background())
+				done <- err
+			}()
+			clk.blockUntil(t, 1)
+			if got := requests.Load(); got != 1 {
+				t.Fatalf("requests before Retry-After elapsed = %d, want 1", got)
+			}
+			clk.Advance(30 * time.Second)
+			if err := <-done; err != nil {
+				t.Fatalf("GetListeningPort: %v", err)
+			}
+			if got := requests.Load(); got != 2 {
+				t.Errorf("requests = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestRateLimitGivesUpAfterRetries(t *testing.T) {
+	srv, requests := rateLimitedServer(t, 100, func() string { return "0" })
+	client := newTestClient(t, testConfig(t, srv.URL, map[string]string{"RATE_LIMIT_RETRIES": "2"}))
+
+	_, err := client.GetListeningPort(context.Background())
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("GetListeningPort error = %v, want ErrRateLimited", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3 (one try and two retries)", got)
+	}
+}
+
+func TestCheckIntervalValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"default", nil, 30 * time.Second, false},
+		{"zero is clamped", map[string]string{"CHECK_INTERVAL": "0"}, time.Second, false},
+		{"negative is clamped", map[string]string{"CHECK_INTERVAL": "-5"}, time.Second, false},
+		{"clamped to MIN_CHECK_INTERVAL", map[string]string{"CHECK_INTERVAL": "5", "MIN_CHECK_INTERVAL": "10s"}, 10 * time.Second, false},
+		{"zero with STRICT_CONFIG", map[string]string{"CHECK_INTERVAL": "0", "STRICT_CONFIG": "true"}, 0, true},
+		{"negative with STRICT_CONFIG", map[string]string{"CHECK_INTERVAL": "-5", "STRICT_CONFIG": "true"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QBITTORRENT_PASSWORD", "secret")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			config, err := loadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadConfig accepted CHECK_INTERVAL=%s", tt.env["CHECK_INTERVAL"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if config.CheckInterval != tt.want {
+				t.Errorf("CheckInterval = %v, want %v", config.CheckInterval, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortSentinels(t *testing.T) {
+	format := portFormat{format: formatAuto, mode: parseStrict, sentinels: []string{"none", "disabled", "disconnected"}}
+	tests := []struct {
+		content string
+		noPort  bool
+	}{
+		{"0", true},
+		{"0\n", true},
+		{"none", true},
+		{"NONE\n", true},
+		{" disabled ", true},
+		{"disconnected", true},
+		{"garbage", false},
+		{"12ab", false},
+		{"-1", false},
+		{"none yet", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := parsePort([]byte(tt.content), format)
+		if err == nil {
+			t.Errorf("parsePort(%q) succeeded, want an error", tt.content)
+			continue
+		}
+		if got := errors.Is(err, ErrNoPort); got != tt.noPort {
+			t.Errorf("parsePort(%q) error %v: ErrNoPort = %v, want %v", tt.content, err, got, tt.noPort)
+		}
+	}
+}
+
+func TestLoginFollowsHTTPSUpgradeRedirect(t *testing.T) {
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusPermanentRedirect} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			qb := newUnstartedFakeQBittorrent(t)
+			qb.StartTLS()
+			var redirects atomic.Int32
+			plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				redirects.Add(1)
+				http.Redirect(w, r, qb.URL+r.URL.RequestURI(), code)
+			}))
+			t.Cleanup(plain.Close)
+
+			config := testConfig(t, plain.URL, map[string]string{"QBITTORRENT_TLS_INSECURE": "true"})
+			client := newTestClient(t, config)
+			ctx := context.Background()
+
+			// The login POST must reach the HTTPS server with its form intact.
+			if err := client.Login(ctx); err != nil {
+				t.Fatalf("Login through %d redirect: %v", code, err)
+			}
+			if got := qb.loginCount(); got != 1 {
+				t.Fatalf("logins on the HTTPS server = %d, want 1", got)
+			}
+			redirected := redirects.Load()
+			if err := client.SetListeningPort(ctx, 51413); err != nil {
+				t.Fatalf("SetListeningPort: %v", err)
+			}
+			if got := qb.listenPort(); got != 51413 {
+				t.Errorf("listen_port = %d, want 51413", got)
+			}
+			if !strings.HasPrefix(client.String(), "https://") {
+				t.Errorf("client still on %s after the upgrade", client.String())
+			}
+			// Later requests go straight to HTTPS.
+			if got := redirects.Load(); got != redirected {
+				t.Errorf("%d more redirects after login, want none", got-redirected)
+			}
+		})
+	}
+}
+
+func TestLoginRejectsCrossHostRedirect(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	plain := httptest.NewServer(http.RedirectHandler(strings.Replace(qb.URL, "127.0.0.1", "localhost", 1)+"/api/v2/auth/login", http.StatusPermanentRedirect))
+	t.Cleanup(plain.Close)
+
+	config := testConfig(t, plain.URL, map[string]string{"FOLLOW_LOGIN_REDIRECTS": "false"})
+	client := newTestClient(t, config)
+	if err := client.Login(context.Background()); err == nil || !strings.Contains(err.Error(), "point QBITTORRENT_URL at the final address") {
+		t.Fatalf("Login error = %v, want advice to point QBITTORRENT_URL at the final address", err)
+	}
+	if got := qb.loginCount(); got != 0 {
+		t.Errorf("logins = %d, want 0", got)
+	}
+}
+
+func TestClientURLJoining(t *testing.T) {
+	config := testConfig(t, "http://localhost:8080", nil)
+	tests := []struct {
+		base      string
+		wantLogin string
+		wantPrefs string
+		wantTorr  string
+	}{
+		{"http://host:8080", "http://host:8080/api/v2/auth/login", "http://host:8080/api/v2/app/preferences", "http://host:8080/api/v2/torrents/info?filter=active"},
+		{"http://host:8080/", "http://host:8080/api/v2/auth/login", "http://host:8080/api/v2/app/preferences", "http://host:8080/api/v2/torrents/info?filter=active"},
+		{"https://host/qbt", "https://host/qbt/api/v2/auth/login", "https://host/qbt/api/v2/app/preferences", "https://host/qbt/api/v2/torrents/info?filter=active"},
+		{"https://host/qbt/", "https://host/qbt/api/v2/auth/login", "https://host/qbt/api/v2/app/preferences", "https://host/qbt/api/v2/torrents/info?filter=active"},
+		{"https://host/qbt//", "https://host/qbt/api/v2/auth/login", "https://host/qbt/api/v2/app/preferences", "https://host/qbt/api/v2/torrents/info?filter=active"},
+		{"https://host/a/b/", "https://host/a/b/api/v2/auth/login", "https://host/a/b/api/v2/app/preferences", "https://host/a/b/api/v2/torrents/info?filter=active"},
+	}
+	for _, tt := range tests {
+		client, err := NewQBittorrentClient(tt.base, http.DefaultTransport, config)
+		if err != nil {
+			t.Fatalf("NewQBittorrentClient(%q): %v", tt.base, err)
+		}
+		if client.loginURL != tt.wantLogin || client.prefsURL != tt.wantPrefs || client.torrentsURL != tt.wantTorr {
+			t.Errorf("NewQBittorrentClient(%q) URLs = %s, %s, %s; want %s, %s, %s", tt.base,
+				client.loginURL, client.prefsURL, client.torrentsURL, tt.wantLogin, tt.wantPrefs, tt.wantTorr)
+		}
+	}
+
+	for _, bad := range []string{"host:8080", "/qbt", "://"} {
+		if _, err := NewQBittorrentClient(bad, http.DefaultTransport, config); err == nil {
+			t.Errorf("NewQBittorrentClient(%q) accepted an invalid URL", bad)
+		}
+	}
+}
+
+func TestClientBehindSubpath(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	mux := http.NewServeMux()
+	mux.Handle("/qbt/", http.StripPrefix("/qbt", qb.Config.Handler))
+	proxy := httptest.NewServer(mux)
+	t.Cleanup(proxy.Close)
+
+	client := newTestClient(t, testConfig(t, proxy.URL+"/qbt/", nil))
+	ctx := context.Background()
+	if err := client.Login(ctx); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := client.SetListeningPort(ctx, 51413); err != nil {
+		t.Fatalf("SetListeningPort: %v", err)
+	}
+	if port, err := client.GetListeningPort(ctx); err != nil || port != 51413 {
+		t.Fatalf("GetListeningPort = %d, %v; want 51413", port, err)
+	}
+}
+
+func TestSetPreferencesErrorBody(t *testing.T) {
+	tests := []struct {
+		reply    string
+		rejected bool
+	}{
+		{"", false},
+		{"Ok.", false},
+		{"Fails.", true},
+		{"Invalid value for listen_port", true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.reply), func(t *testing.T) {
+			qb := newFakeQBittorrent(t)
+			qb.setReply = tt.reply
+			client := newTestClient(t, testConfig(t, qb.URL, nil))
+			ctx := context.Background()
+			if err := client.Login(ctx); err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+
+			err := client.SetListeningPort(ctx, 51413)
+			if got := errors.Is(err, ErrPreferencesRejected); got != tt.rejected {
+				t.Fatalf("SetListeningPort error = %v, rejected = %v, want %v", err, got, tt.rejected)
+			}
+			if tt.rejected && !strings.Contains(err.Error(), tt.reply) {
+				t.Errorf("error %q does not quote qBittorrent's reply %q", err, tt.reply)
+			}
+		})
+	}
+}
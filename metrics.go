@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds monotonic counters and gauges in Prometheus terms. Unlike the
+// heartbeat counters they are never reset, and they are safe to read from
+// other goroutines.
+type metrics struct {
+	syncs       atomic.Int64
+	errors      atomic.Int64
+	drift       atomic.Int64
+	portUpdates atomic.Int64
+	port        atomic.Int64
+	qbPort      atomic.Int64
+	lastSync    atomic.Int64 // unix seconds
+	lastSuccess atomic.Int64 // unix seconds
+
+	stageErrors [len(errorStageNames)]atomic.Int64
+	// loginFailures counts failed logins since the last successful sync.
+	loginFailures atomic.Int64
+	// breakersOpen counts clients whose circuit breaker is open.
+	breakersOpen atomic.Int64
+
+	// sources has one entry per port source when PORT_SOURCE lists several.
+	sources []*sourceMetrics
+}
+
+// errorStage is the step of a sync an error is attributed to in
+// portsync_sync_errors_total.
+type errorStage int
+
+const (
+	stageRead errorStage = iota
+	stageGet
+	stageSet
+	stageLogin
+	stageHook
+)
+
+var errorStageNames = [...]string{"read", "get", "set", "login", "hook"}
+
+func (s errorStage) String() string {
+	return errorStageNames[s]
+}
+
+type sourceMetrics struct {
+	name  string
+	age   atomic.Int64 // seconds since the source's value last changed
+	stale atomic.Bool
+}
+
+func (m *metrics) recordSuccess(port int) {
+	m.port.Store(int64(port))
+	m.qbPort.Store(int64(port))
+	m.lastSuccess.Store(time.Now().Unix())
+	m.loginFailures.Store(0)
+}
+
+// writeTo renders the metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	write := func(name, kind, help string, value int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	write("portsync_sync_attempts_total", "counter", "Sync cycles run.", m.syncs.Load())
+	fmt.Fprintf(bw, "# HELP portsync_sync_errors_total Errors encountered while syncing, by stage.\n# TYPE portsync_sync_errors_total counter\n")
+	for i, name := range errorStageNames {
+		fmt.Fprintf(bw, "portsync_sync_errors_total{stage=%q} %d\n", name, m.stageErrors[i].Load())
+	}
+	write("portsync_drift_total", "counter", "Times qBittorrent was found on a different port than last applied.", m.drift.Load())
+	write("portsync_port_updates_total", "counter", "Successful writes of the listening port to qBittorrent.", m.portUpdates.Load())
+	write("portsync_current_port", "gauge", "Listening port last confirmed in qBittorrent.", m.port.Load())
+	write("portsync_last_sync_timestamp_seconds", "gauge", "Unix time of the last sync attempt.", m.lastSync.Load())
+	write("portsync_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync.", m.lastSuccess.Load())
+	write("portsync_login_failures", "gauge", "Failed logins since the last successful sync.", m.loginFailures.Load())
+	write("portsync_circuit_breaker_open", "gauge", "Clients whose circuit breaker is open.", m.breakersOpen.Load())
+	if len(m.sources) > 0 {
+		fmt.Fprintf(bw, "# HELP portsync_source_age_seconds Age of each port source's value, where the source can tell.\n# TYPE portsync_source_age_seconds gauge\n")
+		for _, s := range m.sources {
+			fmt.Fprintf(bw, "portsync_source_age_seconds{source=%q} %d\n", s.name, s.age.Load())
+		}
+		fmt.Fprintf(bw, "# HELP portsync_source_stale Whether each port source is past its staleness threshold.\n# TYPE portsync_source_stale gauge\n")
+		for _, s := range m.sources {
+			stale := 0
+			if s.stale.Load() {
+				stale = 1
+			}
+			fmt.Fprintf(bw, "portsync_source_stale{source=%q} %d\n", s.name, stale)
+		}
+	}
+	return bw.Flush()
+}
+
+func (m *metrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// writeTextfile writes the metrics for node_exporter's textfile collector,
+// atomically so the collector never sees a partial file.
+func (m *metrics) writeTextfile(path string) error {
+	var buf bytes.Buffer
+	if err := m.writeTo(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0o644)
+}
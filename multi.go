@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// multiClient keeps several independent qBittorrent instances, typically
+// containers sharing one VPN, on the same forwarded port. Unlike an haClient
+// every instance has its own listening port: a read only reports a port when
+// all reachable instances agree on it, and a write goes to each instance
+// that is not on it yet. An unreachable instance is logged and skipped so it
+// cannot hold up the others.
+type multiClient struct {
+	instances []TorrentClient
+	// ports is what each instance reported on the last read, 0 where the
+	// read failed.
+	ports       []int
+	concurrency int
+}
+
+// missing reports whether any instance failed the last read.
+func (m *multiClient) missing() bool {
+	for _, port := range m.ports {
+		if port == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Login logs in to every instance, at most STARTUP_CONCURRENCY at a time,
+// and only fails when none of them accepted it.
+func (m *multiClient) Login(ctx context.Context) error {
+	failed := forEachInstance(ctx, m.instances, m.concurrency, func(ctx context.Context, inst TorrentClient) error {
+		err := inst.Login(ctx)
+		if err != nil {
+			slog.Warn("Login failed on instance", append([]any{"instance", inst.String()}, errAttrs(err)...)...)
+		}
+		return err
+	})
+	if len(failed) == len(m.instances) {
+		return fmt.Errorf("login failed on all %d instances: %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
+
+func (m *multiClient) CheckHealth(ctx context.Context) error {
+	var errs []error
+	for _, inst := range m.instances {
+		err := inst.CheckHealth(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no instance is healthy: %w", errors.Join(errs...))
+}
+
+func (m *multiClient) CheckSession(ctx context.Context) error {
+	var errs []error
+	for _, inst := range m.instances {
+		if _, err := withReauth(ctx, inst, func() (int, error) { return 0, inst.CheckSession(ctx) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(m.instances) {
+		return fmt.Errorf("session check failed on all %d instances: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// GetListeningPort returns the port the reachable instances share. When they
+// disagree it returns 0, which never matches a forwarded port, so the caller
+// goes on to set the port everywhere.
+func (m *multiClient) GetListeningPort(ctx context.Context) (int, error) {
+	var errs []error
+	for i, inst := range m.instances {
+		port, err := withReauth(ctx, inst, func() (int, error) { return inst.GetListeningPort(ctx) })
+		if err != nil {
+			slog.Warn("Failed to read port from instance", append([]any{"instance", inst.String()}, errAttrs(err)...)...)
+			errs = append(errs, err)
+			port = 0
+		}
+		m.ports[i] = port
+	}
+	if len(errs) == len(m.instances) {
+		return 0, fmt.Errorf("no instance answered: %w", errors.Join(errs...))
+	}
+
+	agreed := 0
+	for _, port := range m.ports {
+		if port == 0 {
+			continue
+		}
+		if agreed != 0 && port != agreed {
+			slog.Info("qBittorrent instances disagree on the listening port", "ports", m.describePorts())
+			return 0, nil
+		}
+		agreed = port
+	}
+	return agreed, nil
+}
+
+// SetListeningPort sets port on every instance not already on it, or on all
+// of them when none needs it (a forced write). It fails if any instance that
+// answered the last read rejects the change, so the caller retries; an
+// instance that was already unreachable is only logged.
+func (m *multiClient) SetListeningPort(ctx context.Context, port int) error {
+	all := !slices.ContainsFunc(m.ports, func(p int) bool { return p != port })
+	var errs []error
+	rejected := 0
+	for i, inst := range m.instances {
+		if m.ports[i] == port && !all {
+			continue
+		}
+		_, err := withReauth(ctx, inst, func() (int, error) { return 0, inst.SetListeningPort(ctx, port) })
+		if err != nil {
+			slog.Warn("Failed to set port on instance", append([]any{"instance", inst.String(), "port", port}, errAttrs(err)...)...)
+			errs = append(errs, err)
+			if m.ports[i] != 0 {
+				rejected++
+			}
+			continue
+		}
+		slog.Info("Set port on instance", "instance", inst.String(), "port", port)
+	}
+	if len(errs) == len(m.instances) || rejected > 0 {
+		return fmt.Errorf("set failed on %d of %d instances: %w", len(errs), len(m.instances), errors.Join(errs...))
+	}
+	return nil
+}
+
+// CountActiveTorrents adds up the reachable instances, so APPLY_WHEN sees
+// the torrents of all of them.
+func (m *multiClient) CountActiveTorrents(ctx context.Context) (int, error) {
+	var errs []error
+	total := 0
+	for _, inst := range m.instances {
+		n, err := withReauth(ctx, inst, func() (int, error) { return inst.CountActiveTorrents(ctx) })
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		total += n
+	}
+	if len(errs) == len(m.instances) {
+		return 0, fmt.Errorf("no instance answered: %w", errors.Join(errs...))
+	}
+	return total, nil
+}
+
+// ConnectionStatus reports "connected" only when every reachable instance
+// is, otherwise the first status that isn't.
+func (m *multiClient) ConnectionStatus(ctx context.Context) (string, error) {
+	var errs []error
+	worst := ""
+	for _, inst := range m.instances {
+		var status string
+		_, err := withReauth(ctx, inst, func() (int, error) {
+			var err error
+			status, err = inst.ConnectionStatus(ctx)
+			return 0, err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if worst == "" || worst == "connected" {
+			worst = status
+		}
+	}
+	if worst == "" {
+		return "", fmt.Errorf("no instance answered: %w", errors.Join(errs...))
+	}
+	return worst, nil
+}
+
+func (m *multiClient) Version(ctx context.Context) (string, error) {
+	var version string
+	err := firstAnswer(ctx, m.instances, func(inst TorrentClient) (err error) {
+		version, err = inst.Version(ctx)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("no instance answered: %w", err)
+	}
+	return version, nil
+}
+
+func (m *multiClient) GetPreferencesRaw(ctx context.Context) ([]byte, error) {
+	var data []byte
+	err := firstAnswer(ctx, m.instances, func(inst TorrentClient) (err error) {
+		data, err = inst.GetPreferencesRaw(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no instance answered: %w", err)
+	}
+	return data, nil
+}
+
+func (m *multiClient) SetPreferencesRaw(ctx context.Context, prefs []byte) error {
+	errs := forEachInstance(ctx, m.instances, m.concurrency, func(ctx context.Context, inst TorrentClient) error {
+		_, err := withReauth(ctx, inst, func() (int, error) { return 0, inst.SetPreferencesRaw(ctx, prefs) })
+		if err != nil {
+			slog.Warn("Failed to set preferences on instance", append([]any{"instance", inst.String()}, errAttrs(err)...)...)
+		}
+		return err
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("set failed on %d of %d instances: %w", len(errs), len(m.instances), errors.Join(errs...))
+	}
+	return nil
+}
+
+func (m *multiClient) ValidateSetPayload(port int) (string, error) {
+	return m.instances[0].ValidateSetPayload(port)
+}
+
+func (m *multiClient) String() string {
+	names := make([]string, len(m.instances))
+	for i, inst := range m.instances {
+		names[i] = inst.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func (m *multiClient) describePorts() string {
+	parts := make([]string, len(m.instances))
+	for i, inst := range m.instances {
+		parts[i] = fmt.Sprintf("%s=%d", inst.String(), m.ports[i])
+	}
+	return strings.Join(parts, " ")
+}
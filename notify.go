@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Values for NOTIFY_TYPE.
+const (
+	notifyNtfy    = "ntfy"
+	notifyGotify  = "gotify"
+	notifyDiscord = "discord"
+	notifyGeneric = "generic"
+)
+
+// notifier tells a person, rather than a program, that the listening port
+// changed, so trackers that need the port by hand can be updated. Sends run
+// in the background with a few quick retries; a notification service that is
+// down is logged and otherwise ignored.
+type notifier struct {
+	kind    string
+	url     string
+	client  *http.Client
+	policy  backoffPolicy
+	pending sync.WaitGroup
+}
+
+func newNotifier(config *Config) *notifier {
+	if config.NotifyURL == "" {
+		return nil
+	}
+	return &notifier{
+		kind:   config.NotifyType,
+		url:    config.NotifyURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		policy: backoffPolicy{maxAttempts: 3, baseDelay: time.Second, maxDelay: 5 * time.Second, clock: realClock{}},
+	}
+}
+
+func (n *notifier) notify(ctx context.Context, port, previousPort int) {
+	if n == nil {
+		return
+	}
+	// The sync's context ends as soon as the sync does; the send gets its
+	// own bound instead.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	n.pending.Add(1)
+	go func() {
+		defer n.pending.Done()
+		defer cancel()
+		err := retryWithBackoff(ctx, n.policy, "notify", func() error {
+			return n.send(ctx, port, previousPort)
+		})
+		if err != nil {
+			slog.Warn("Failed to send port change notification", "notify_type", n.kind, "port", port, "error", err)
+			return
+		}
+		slog.Debug("Sent port change notification", "notify_type", n.kind, "port", port)
+	}()
+}
+
+// wait blocks until in-flight notifications finish, so a one-shot run does
+// not exit before they are sent.
+func (n *notifier) wait() {
+	if n != nil {
+		n.pending.Wait()
+	}
+}
+
+func (n *notifier) send(ctx context.Context, port, previousPort int) error {
+	title := "qBittorrent port changed"
+	message := fmt.Sprintf("Listening port changed from %d to %d", previousPort, port)
+
+	var body []byte
+	contentType := "application/json"
+	switch n.kind {
+	case notifyNtfy:
+		body, contentType = []byte(message), "text/plain; charset=utf-8"
+	case notifyGotify:
+		body, _ = json.Marshal(map[string]any{"title": title, "message": message, "priority": 5})
+	case notifyDiscord:
+		body, _ = json.Marshal(map[string]string{"content": "**" + title + "**\n" + message})
+	default:
+		body, _ = json.Marshal(map[string]any{"port": port, "previous_port": previousPort, "message": message})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if n.kind == notifyNtfy {
+		req.Header.Set("Title", title)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// *url.Error repeats the full URL, and Discord and Gotify keep
+		// their token in it.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError("notify", n.url, resp.StatusCode, nil, fmt.Sprintf("%s returned status %d", n.kind, resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values for PORT_FILE_SELECT.
+const (
+	// portFileFirstExisting reads the first PORT_FILE entry that exists.
+	portFileFirstExisting = "first-existing"
+	// portFileSpecific gives each qBittorrent instance in QBITTORRENT_URL
+	// the PORT_FILE entry at the same position.
+	portFileSpecific = "specific"
+)
+
+// portFileEntries splits PORT_FILE into its comma-separated entries, each a
+// path or a glob pattern such as /tmp/gluetun/*/forwarded_port.
+func portFileEntries(spec string) []string {
+	return splitList(spec, ",")
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// resolvePortFile returns the first file named by spec that exists, trying
+// the entries in order and the matches of a pattern in lexical order. A
+// single plain path is returned as-is so that reading it reports the usual
+// error.
+func resolvePortFile(spec string) (string, error) {
+	entries := portFileEntries(spec)
+	if len(entries) == 1 && !isGlob(entries[0]) {
+		return entries[0], nil
+	}
+	for _, entry := range entries {
+		candidates := []string{entry}
+		if isGlob(entry) {
+			matches, err := filepath.Glob(entry)
+			if err != nil {
+				return "", fmt.Errorf("PORT_FILE pattern %q: %w", entry, err)
+			}
+			candidates = matches
+		}
+		for _, path := range candidates {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("none of %s: %w", spec, fs.ErrNotExist)
+}
+
+// resolve picks the file to read and logs when that changes, so it is
+// clear which of several candidates is in use.
+func (s *filePortSource) resolve() (string, error) {
+	path, err := resolvePortFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	if path != s.resolved {
+		if path != s.path {
+			attrs := []any{"port_file", path}
+			if s.client != "" {
+				attrs = append(attrs, "client", s.client)
+			}
+			slog.Info("Using port file", attrs...)
+		}
+		s.resolved = path
+	}
+	return path, nil
+}
+
+// portFileLanes splits syncer into one lane per qBittorrent instance, each
+// reading the PORT_FILE entry at the instance's position, for
+// PORT_FILE_SELECT=specific. loadConfig has checked that the counts match.
+func portFileLanes(syncer *Syncer, config *Config) []*Syncer {
+	instances := []TorrentClient{syncer.client}
+	if m, ok := syncer.client.(*multiClient); ok {
+		instances = m.instances
+	}
+	paths := portFileEntries(config.PortFile)
+	lanes := make([]*Syncer, len(instances))
+	for i, inst := range instances {
+		source := withPortRange(&filePortSource{path: paths[i], format: newPortFormat(config), lock: config.UseFileLock, client: inst.String(), clock: syncer.clock}, config)
+		slog.Info("Port file for qBittorrent instance", "client", inst.String(), "port_file", paths[i])
+		lanes[i] = syncer.lane(inst, source)
+	}
+	return lanes
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// portRange maps a forwarded base port onto the ports a client listens on:
+// PORT_OFFSET is added to the base, and the PORT_RANGE ports from there on
+// are used by clients that take a range (Deluge). qBittorrent and
+// Transmission listen on a single port, the first of the range.
+type portRange struct {
+	offset int
+	size   int
+}
+
+func newPortRange(config *Config) portRange {
+	return portRange{offset: config.PortOffset, size: config.PortRange}
+}
+
+// single reports whether the forwarded port is used as-is.
+func (r portRange) single() bool {
+	return r.offset == 0 && r.size <= 1
+}
+
+// bounds returns the first and last port for base.
+func (r portRange) bounds(base int) (low, high int, err error) {
+	low = base + r.offset
+	high = low + max(r.size, 1) - 1
+	if low < 1 || high > 65535 {
+		return 0, 0, fmt.Errorf("forwarded port %d with PORT_OFFSET %d and PORT_RANGE %d gives ports %d-%d, outside 1-65535",
+			base, r.offset, r.size, low, high)
+	}
+	return low, high, nil
+}
+
+// rangePortSource hands the sync loop the first port of the range instead of
+// the forwarded port, so comparing, applying and verifying stay the same for
+// every client; only the client's own payload widens it to the full range.
+type rangePortSource struct {
+	source PortSource
+	rng    portRange
+}
+
+// withPortRange wraps source when PORT_OFFSET or PORT_RANGE is set.
+func withPortRange(source PortSource, config *Config) PortSource {
+	rng := newPortRange(config)
+	if rng.single() {
+		return source
+	}
+	return &rangePortSource{source: source, rng: rng}
+}
+
+func (s *rangePortSource) GetPort(ctx context.Context) (int, error) {
+	port, err := s.source.GetPort(ctx)
+	if err != nil {
+		return 0, err
+	}
+	low, _, err := s.rng.bounds(port)
+	return low, err
+}
+
+func (s *rangePortSource) String() string {
+	if s.rng.offset == 0 {
+		return s.source.String()
+	}
+	return fmt.Sprintf("%s %+d", s.source, s.rng.offset)
+}
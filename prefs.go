@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// GetPreferencesRaw returns qBittorrent's full preferences document as-is.
+func (c *QBittorrentClient) GetPreferencesRaw(ctx context.Context) ([]byte, error) {
+	const op = "get_preferences"
+
+	resp, err := c.get(ctx, op, c.prefsURL)
+	if err != nil {
+		return nil, newAPIError(op, c.prefsURL, 0, err, "failed to get preferences")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, newAPIError(op, c.prefsURL, resp.StatusCode, ErrAuthExpired, "request rejected")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(op, c.prefsURL, resp.StatusCode, nil, fmt.Sprintf("unexpected status code: %d", resp.StatusCode))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newAPIError(op, c.prefsURL, resp.StatusCode, err, "failed to read preferences")
+	}
+	return data, nil
+}
+
+// SetPreferencesRaw posts a full or partial preferences document back.
+func (c *QBittorrentClient) SetPreferencesRaw(ctx context.Context, prefs []byte) error {
+	return c.postPreferences(ctx, "json="+url.QueryEscape(string(prefs)))
+}
+
+// parseExtraPreferences parses EXTRA_PREFERENCES, a JSON object of
+// preferences sent with every port change, such as {"upnp": false}.
+// portKey is left out because it is the one being synced.
+func parseExtraPreferences(s, portKey string) (map[string]any, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var prefs map[string]any
+	if err := dec.Decode(&prefs); err != nil {
+		return nil, fmt.Errorf("EXTRA_PREFERENCES is not a valid JSON object: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("EXTRA_PREFERENCES has trailing data after the JSON object")
+	}
+	if prefs == nil {
+		return nil, fmt.Errorf("EXTRA_PREFERENCES must be a JSON object, got null")
+	}
+	if _, ok := prefs[portKey]; ok {
+		return nil, fmt.Errorf("EXTRA_PREFERENCES must not set %s; it is taken from the port source", portKey)
+	}
+	return prefs, nil
+}
+
+// snapshotPreferences writes qBittorrent's full preferences to path. Nothing
+// is redacted, so the file is only readable by its owner.
+func snapshotPreferences(ctx context.Context, client TorrentClient, path string) error {
+	data, err := client.GetPreferencesRaw(ctx)
+	if err != nil {
+		return err
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, data, "", "  "); err != nil {
+		return fmt.Errorf("preferences are not valid JSON: %w", err)
+	}
+	pretty.WriteByte('\n')
+	return writeFileAtomic(path, pretty.Bytes(), 0o600)
+}
+
+// restorePreferences posts a snapshot written by snapshotPreferences back to
+// qBittorrent.
+func restorePreferences(ctx context.Context, client TorrentClient, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var prefs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return fmt.Errorf("%s is not a preferences snapshot: %w", path, err)
+	}
+	compact, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	return client.SetPreferencesRaw(ctx, compact)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultRedactKeys are the environment variables whose values never appear
+// in logs, probes, events or reports. REDACT_KEYS replaces the list; entries
+// are shell-style patterns matched against the variable name.
+const defaultRedactKeys = "*_PASSWORD,*_PASSWORD_2,*_TOKEN,*_SECRET,*_API_KEY,AUTH_HEADER_VALUE"
+
+// minRedactLen keeps very short values (a port, "true") from being blanked
+// out of every log line when someone names a non-secret *_TOKEN.
+const minRedactLen = 4
+
+var redactSecrets atomic.Pointer[[]string]
+
+var urlUserinfo = regexp.MustCompile(`://[^/@\s]+@`)
+
+// setupRedaction collects the secrets to scrub: the configured passwords,
+// which may have come from *_FILE, plus every environment variable or
+// CONFIG_FILE key matching the redact key patterns.
+func setupRedaction(config *Config) {
+	var secrets []string
+	add := func(s string) {
+		if len(s) >= minRedactLen {
+			secrets = append(secrets, s)
+		}
+	}
+	add(config.Password)
+	add(config.Password2)
+	add(config.DelugePassword)
+	add(config.TransmissionPassword)
+	add(config.GluetunAPIKey)
+	add(config.AuthHeaderValue)
+
+	matches := func(key string) bool {
+		for _, p := range config.RedactKeys {
+			if ok, _ := path.Match(p, key); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, kv := range os.Environ() {
+		if key, value, _ := strings.Cut(kv, "="); matches(key) {
+			add(value)
+		}
+	}
+	for key, value := range fileConfig {
+		if matches(key) {
+			add(value)
+		}
+	}
+	redactSecrets.Store(&secrets)
+}
+
+// redact scrubs known secrets and URL credentials from s. Everything that
+// serializes config or errors goes through it, including the log handler.
+func redact(s string) string {
+	s = urlUserinfo.ReplaceAllString(s, "://REDACTED@")
+	if secrets := redactSecrets.Load(); secrets != nil {
+		for _, secret := range *secrets {
+			s = strings.ReplaceAll(s, secret, "REDACTED")
+		}
+	}
+	return s
+}
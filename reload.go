@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// reloadable are the configAttrs keys a SIGHUP applies without a restart.
+var reloadable = []string{"check_interval", "port_file"}
+
+// reloadConfig re-reads the configuration on SIGHUP and applies the settings
+// that can change at runtime, CHECK_INTERVAL and PORT_FILE, to config in
+// place. Any other change, credentials included, is named in a warning and
+// left for the next restart. An invalid configuration is logged and the
+// running one kept.
+//
+// A process's environment and flags are fixed once it starts, so in practice
+// only edits to CONFIG_FILE (and to *_FILE secrets) are picked up.
+func reloadConfig(config *Config, syncer *Syncer) (intervalChanged, portFileChanged bool) {
+	if config.ConfigFile == "" {
+		slog.Warn("SIGHUP received without CONFIG_FILE; the environment cannot change while running, so only a restart applies new settings")
+	}
+	next, err := loadConfig()
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the running configuration", "error", err)
+		return false, false
+	}
+
+	if next.CheckInterval != config.CheckInterval {
+		slog.Info("Check interval changed", "previous", config.CheckInterval, "check_interval", next.CheckInterval)
+		config.CheckInterval = next.CheckInterval
+		syncer.health.staleAfter.Store(int64(3 * next.CheckInterval))
+		intervalChanged = true
+	}
+	if next.PortFile != config.PortFile && config.PortFileSelect == portFileSpecific {
+		slog.Warn("PORT_FILE only takes effect after a restart with PORT_FILE_SELECT=specific", "port_file", next.PortFile)
+	} else if next.PortFile != config.PortFile {
+		slog.Info("Port file changed", "previous", config.PortFile, "port_file", next.PortFile)
+		config.PortFile = next.PortFile
+		setPortFile(syncer.source, next.PortFile)
+		portFileChanged = true
+	}
+
+	if restart := restartOnlyChanges(config, next); len(restart) > 0 {
+		slog.Warn("Some changed settings only take effect after a restart", "settings", restart)
+	}
+	slog.Info("Configuration reloaded", configAttrs(config)...)
+	return intervalChanged, portFileChanged
+}
+
+// restartOnlyChanges lists the settings that differ between the running and
+// the reloaded configuration but cannot be applied in place.
+func restartOnlyChanges(running, next *Config) []string {
+	before, after := attrMap(configAttrs(running)), attrMap(configAttrs(next))
+	var changed []string
+	for key, value := range after {
+		if before[key] != value && !slices.Contains(reloadable, key) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok && !slices.Contains(reloadable, key) {
+			changed = append(changed, key)
+		}
+	}
+	// Secrets never appear in configAttrs, so compare them directly.
+	if running.Password != next.Password || running.Password2 != next.Password2 ||
+		running.TransmissionPassword != next.TransmissionPassword || running.DelugePassword != next.DelugePassword ||
+		running.GluetunAPIKey != next.GluetunAPIKey || running.AuthHeaderValue != next.AuthHeaderValue {
+		changed = append(changed, "credentials")
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+func attrMap(attrs []any) map[string]string {
+	m := make(map[string]string, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		m[fmt.Sprint(attrs[i])] = fmt.Sprint(attrs[i+1])
+	}
+	return m
+}
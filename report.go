@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// changeReport is written to REPORT_FILE after every successful change, so
+// the last known-good change can be read without digging through logs.
+type changeReport struct {
+	Time               time.Time `json:"time"`
+	Source             string    `json:"source"`
+	OldPort            int       `json:"old_port"`
+	NewPort            int       `json:"new_port"`
+	QBittorrent        string    `json:"qbittorrent"`
+	QBittorrentVersion string    `json:"qbittorrent_version,omitempty"`
+	// Verified is true only when CONFIRM_BIND saw qBittorrent report the
+	// new port after the write.
+	Verified bool `json:"verified"`
+}
+
+func (s *Syncer) writeReport(ctx context.Context, oldPort, newPort int, verified bool) {
+	if s.config.ReportFile == "" {
+		return
+	}
+
+	report := changeReport{
+		Time:        time.Now().UTC(),
+		Source:      redact(s.source.String()),
+		OldPort:     oldPort,
+		NewPort:     newPort,
+		QBittorrent: s.client.String(),
+		Verified:    verified,
+	}
+	// The version is nice to have; a failure here shouldn't lose the report.
+	if version, err := s.client.Version(ctx); err == nil {
+		report.QBittorrentVersion = version
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		slog.Warn("Failed to encode change report", "error", err)
+		return
+	}
+	if err := writeFileAtomic(s.config.ReportFile, append(data, '\n'), 0o644); err != nil {
+		slog.Warn("Failed to write change report", "path", s.config.ReportFile, "error", err)
+	}
+}
+
+// writeFileAtomic replaces path with data via a temp file in the same
+// directory, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
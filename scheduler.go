@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Values for SCHEDULER.
+const (
+	schedulerTicker    = "ticker"
+	schedulerMonotonic = "monotonic"
+)
+
+// suspendAwareTicker fires every interval like time.Ticker, but also notices
+// when the machine was suspended. Go's monotonic clock stops during suspend,
+// so a plain ticker resumes counting where it left off and the sync can be
+// an interval late. Here a short check compares both the monotonic and the
+// wall clock against the last run; after a resume the wall clock is ahead and
+// exactly one catch-up sync fires, then the schedule restarts from there.
+type suspendAwareTicker struct {
+	C        <-chan time.Time
+	c        chan time.Time
+	clock    clock
+	interval time.Duration
+}
+
+func newSuspendAwareTicker(ctx context.Context, clock clock, interval time.Duration) *suspendAwareTicker {
+	c := make(chan time.Time, 1)
+	t := &suspendAwareTicker{C: c, c: c, clock: clock, interval: interval}
+	go t.run(ctx)
+	return t
+}
+
+func (t *suspendAwareTicker) run(ctx context.Context) {
+	// The wall clock is checked at least this often, which bounds how late
+	// the catch-up sync after a resume can be.
+	const maxSleep = 5 * time.Second
+
+	last := t.clock.Now()
+	for {
+		wait := min(last.Add(t.interval).Sub(t.clock.Now()), maxSleep)
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-t.clock.After(wait):
+		}
+
+		monoElapsed := now.Sub(last)
+		wallElapsed := now.Round(0).Sub(last.Round(0))
+		if monoElapsed < t.interval && wallElapsed < t.interval {
+			continue
+		}
+		if suspended := wallElapsed - monoElapsed; suspended > maxSleep {
+			slog.Info("Clock jumped ahead (suspend/resume?), running a catch-up sync", "suspended", suspended.Round(time.Second))
+		}
+		last = now
+		// Like time.Ticker, drop the tick if the loop is still busy rather
+		// than queueing a burst.
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchdog speaks systemd's sd_notify protocol when NOTIFY_SOCKET is set:
+// READY=1 after the first successful sync, WATCHDOG=1 after every one since.
+// After maxFailures failed cycles in a row it stops pinging, so a unit with
+// WatchdogSec= gets restarted instead of looping on the same error.
+type watchdog struct {
+	conn *net.UnixConn
+	// enabled is set when systemd asked for WATCHDOG=1 pings; READY=1 and
+	// STOPPING=1 are sent either way.
+	enabled     bool
+	ready       bool
+	failures    int
+	maxFailures int
+}
+
+// newWatchdog returns nil when not running under systemd, and every method
+// is a no-op on nil.
+func newWatchdog(config *Config) *watchdog {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to connect to NOTIFY_SOCKET, systemd notifications disabled", "error", err)
+		return nil
+	}
+
+	w := &watchdog{conn: conn, maxFailures: config.WatchdogMaxFailures}
+	interval, ok := watchdogInterval()
+	if ok {
+		w.enabled = true
+		slog.Info("systemd watchdog enabled", "watchdog_sec", interval, "max_failures", w.maxFailures)
+		if config.CheckInterval >= interval {
+			slog.Warn("CHECK_INTERVAL is not shorter than WatchdogSec; systemd will restart the service between checks",
+				"check_interval", config.CheckInterval, "watchdog_sec", interval)
+		}
+	}
+	return w
+}
+
+// watchdogInterval reads WATCHDOG_USEC, which systemd sets when the unit has
+// WatchdogSec=. WATCHDOG_PID, when present, must name this process: the
+// variables are inherited by children that should not ping on our behalf.
+func watchdogInterval() (time.Duration, bool) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+func (w *watchdog) send(state string) {
+	if _, err := w.conn.Write([]byte(state)); err != nil {
+		slog.Debug("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+func (w *watchdog) succeeded() {
+	if w == nil {
+		return
+	}
+	if w.failures >= w.maxFailures && w.enabled {
+		slog.Info("Sync recovered, resuming systemd watchdog pings")
+	}
+	w.failures = 0
+	if !w.ready {
+		w.ready = true
+		w.send("READY=1")
+	}
+	if w.enabled {
+		w.send("WATCHDOG=1")
+	}
+}
+
+func (w *watchdog) failed() {
+	if w == nil {
+		return
+	}
+	w.failures++
+	if w.failures == w.maxFailures && w.enabled {
+		slog.Warn("Sync keeps failing, stopping systemd watchdog pings", "failures", w.failures)
+	}
+}
+
+// stopping tells systemd that the shutdown is deliberate.
+func (w *watchdog) stopping() {
+	if w != nil {
+		w.send("STOPPING=1")
+	}
+}
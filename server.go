@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// httpServers groups handlers by listen address, so features configured with
+// their own *_ADDR variables can share a single listener when the addresses
+// match.
+type httpServers struct {
+	muxes map[string]*http.ServeMux
+	order []string
+}
+
+func newHTTPServers() *httpServers {
+	return &httpServers{muxes: make(map[string]*http.ServeMux)}
+}
+
+func (h *httpServers) handle(addr, pattern string, handler http.HandlerFunc) {
+	mux, ok := h.muxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		h.muxes[addr] = mux
+		h.order = append(h.order, addr)
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// start launches every configured listener; each one is shut down when ctx
+// is cancelled.
+func (h *httpServers) start(ctx context.Context) {
+	for _, addr := range h.order {
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           h.muxes[addr],
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			slog.Info("HTTP server listening", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server failed", "addr", srv.Addr, "error", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+	}
+}
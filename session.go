@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// sessionFileMu serialises read-modify-write of SESSION_FILE, which holds
+// one SID per qBittorrent address and is updated by concurrent logins.
+var sessionFileMu sync.Mutex
+
+func readSessionFile(path string) (map[string]string, error) {
+	sessions := map[string]string{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// resumeSession installs the SID saved for this address, if any, and keeps
+// it when qBittorrent still accepts it. It is tried once, on the first
+// Login, so a crash loop doesn't add a login (and a step towards a WebUI
+// ban) per restart.
+func (c *QBittorrentClient) resumeSession(ctx context.Context) bool {
+	sessionFileMu.Lock()
+	sessions, err := readSessionFile(c.sessionFile)
+	sessionFileMu.Unlock()
+	if err != nil {
+		slog.Warn("Failed to read session file, logging in", "path", c.sessionFile, "error", err)
+		return false
+	}
+	sid := sessions[c.baseURL]
+	if sid == "" {
+		return false
+	}
+
+	c.setSessionCookie(sid)
+	if err := c.CheckSession(ctx); err != nil {
+		slog.Info("Saved qBittorrent session is no longer valid, logging in", errAttrs(err)...)
+		c.setSessionCookie("")
+		return false
+	}
+	slog.Info("Reusing saved qBittorrent session", "path", c.sessionFile)
+	return true
+}
+
+// saveSession records the current SID for this address, readable only by
+// us since it grants full WebUI access.
+func (c *QBittorrentClient) saveSession() {
+	sessionFileMu.Lock()
+	defer sessionFileMu.Unlock()
+
+	sessions, err := readSessionFile(c.sessionFile)
+	if err != nil {
+		// A corrupt file is replaced rather than blocking the save.
+		sessions = map[string]string{}
+	}
+	sessions[c.baseURL] = c.sid
+	data, err := json.Marshal(sessions)
+	if err == nil {
+		err = writeFileAtomic(c.sessionFile, data, 0o600)
+	}
+	if err != nil {
+		slog.Warn("Failed to save qBittorrent session", "path", c.sessionFile, "error", err)
+	}
+}
+
+// setSessionCookie installs sid as the session cookie for the API host, or
+// removes the cookie when sid is empty.
+func (c *QBittorrentClient) setSessionCookie(sid string) {
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return
+	}
+	cookie := &http.Cookie{Name: "SID", Value: sid, Path: "/"}
+	if sid == "" {
+		cookie.MaxAge = -1
+	}
+	c.sid = sid
+	c.httpClient.Jar.SetCookies(base, []*http.Cookie{cookie})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// EventSink receives port-change events. The payload is the same JSON the
+// ON_CHANGE_URL webhook gets.
+type EventSink interface {
+	Publish(ctx context.Context, payload []byte) error
+	String() string
+}
+
+func newEventSink(config *Config) (EventSink, error) {
+	target := config.EventSinkURL
+	switch config.EventSink {
+	case "":
+		return nil, nil
+	case "file":
+		return &fileSink{path: target}, nil
+	case "webhook":
+		return &webhookSink{url: target, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "nats", "redis":
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("EVENT_SINK_URL %q is not a valid %s URL", redactURL(target), config.EventSink)
+		}
+		if config.EventSink == "nats" {
+			return &natsSink{url: u, subject: config.EventSinkTopic}, nil
+		}
+		return &redisSink{url: u, channel: config.EventSinkTopic}, nil
+	default:
+		return nil, fmt.Errorf("unknown EVENT_SINK %q (want file, webhook, nats or redis)", config.EventSink)
+	}
+}
+
+// eventPublisher hands events to a sink from its own goroutine. The queue is
+// small and publish never blocks: if the sink is down long enough to fill it,
+// new events are dropped rather than holding up a sync.
+type eventPublisher struct {
+	sink  EventSink
+	queue chan []byte
+}
+
+func newEventPublisher(ctx context.Context, sink EventSink) *eventPublisher {
+	p := &eventPublisher{sink: sink, queue: make(chan []byte, 16)}
+	go p.run(ctx)
+	return p
+}
+
+func (p *eventPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-p.queue:
+			pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := p.sink.Publish(pubCtx, payload); err != nil {
+				slog.Warn("Failed to publish event", "sink", p.sink.String(), "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+func (p *eventPublisher) publish(port, previousPort int) {
+	if p == nil {
+		return
+	}
+	payload, _ := json.Marshal(map[string]int{"port": port, "previous_port": previousPort})
+	select {
+	case p.queue <- payload:
+	default:
+		slog.Warn("Event queue full, dropping event", "sink", p.sink.String(), "port", port)
+	}
+}
+
+// fileSink appends one JSON line per event.
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Publish(ctx context.Context, payload []byte) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(payload, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileSink) String() string {
+	return "file " + s.path
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Publish(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + redactURL(s.url)
+}
+
+// natsSink speaks just enough of the NATS text protocol to publish one
+// message per connection: events are rare, so a persistent connection isn't
+// worth the reconnect handling.
+type natsSink struct {
+	url     *url.URL
+	subject string
+}
+
+func (s *natsSink) Publish(ctx context.Context, payload []byte) error {
+	conn, r, err := dialSink(ctx, s.url, "4222")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The server greets with INFO before accepting anything.
+	if line, err := r.ReadString('\n'); err != nil {
+		return fmt.Errorf("reading INFO: %w", err)
+	} else if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "qbittorrent-port-sync"}
+	if user := s.url.User; user != nil {
+		opts["user"] = user.Username()
+		if pass, ok := user.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+	connect, _ := json.Marshal(opts)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CONNECT %s\r\nPUB %s %d\r\n", connect, s.subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// PONG confirms everything before it was processed; errors arrive as -ERR.
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("waiting for PONG: %w", err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+	}
+}
+
+func (s *natsSink) String() string {
+	return "nats " + s.url.Redacted() + " subject " + s.subject
+}
+
+// redisSink sends PUBLISH over RESP, authenticating first when the URL has a
+// password (redis://:secret@host:6379).
+type redisSink struct {
+	url     *url.URL
+	channel string
+}
+
+func (s *redisSink) Publish(ctx context.Context, payload []byte) error {
+	conn, r, err := dialSink(ctx, s.url, "6379")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if user := s.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			args := []string{"AUTH", pass}
+			if name := user.Username(); name != "" {
+				args = []string{"AUTH", name, pass}
+			}
+			if err := redisCommand(conn, r, args...); err != nil {
+				return fmt.Errorf("redis AUTH: %w", err)
+			}
+		}
+	}
+	return redisCommand(conn, r, "PUBLISH", s.channel, string(payload))
+}
+
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "-") {
+		return errors.New(strings.TrimSpace(line[1:]))
+	}
+	return nil
+}
+
+func (s *redisSink) String() string {
+	return "redis " + s.url.Redacted() + " channel " + s.channel
+}
+
+func dialSink(ctx context.Context, u *url.URL, defaultPort string) (net.Conn, *bufio.Reader, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, bufio.NewReader(conn), nil
+}
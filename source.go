@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type PortSource interface {
+	GetPort(ctx context.Context) (int, error)
+	String() string
+}
+
+// filePortSource reads PORT_FILE, which may list several paths or patterns;
+// see resolvePortFile.
+type filePortSource struct {
+	path   string
+	format portFormat
+	lock   bool
+	// client names the instance this file feeds with
+	// PORT_FILE_SELECT=specific, for logging.
+	client string
+	// resolved is the file last read.
+	resolved string
+	// clock paces retries of a half-written file.
+	clock clock
+}
+
+func (s *filePortSource) GetPort(ctx context.Context) (int, error) {
+	path, err := s.resolve()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read port file: %w", err)
+	}
+	return readPortFile(ctx, s.clock, path, s.format, s.lock)
+}
+
+func (s *filePortSource) String() string {
+	return "file " + s.path
+}
+
+// execPortSource runs PORT_CMD through the shell and parses its stdout the
+// same way as the port file, so any script can act as a provider.
+type execPortSource struct {
+	command string
+	timeout time.Duration
+	format  portFormat
+}
+
+func (s *execPortSource) GetPort(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, fmt.Errorf("port command timed out after %v", s.timeout)
+		}
+		// Non-zero exits are treated as transient: the caller logs and
+		// tries again on the next cycle.
+		return 0, fmt.Errorf("port command failed (%v): %s", err, truncate(strings.TrimSpace(stderr.String()), 512))
+	}
+
+	port, err := parsePort(stdout.Bytes(), s.format)
+	if err != nil {
+		return 0, fmt.Errorf("port command output: %w", err)
+	}
+	return port, nil
+}
+
+func (s *execPortSource) String() string {
+	return "command " + s.command
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+func newPortSource(config *Config) (PortSource, error) {
+	names := splitList(config.PortSource, ",")
+	if len(names) == 1 {
+		src, err := newSinglePortSource(names[0], config)
+		if err != nil {
+			return nil, err
+		}
+		return withPortRange(src, config), nil
+	}
+
+	fb := &fallbackPortSource{}
+	for _, name := range names {
+		src, err := newSinglePortSource(name, config)
+		if err != nil {
+			return nil, err
+		}
+		var maxAge time.Duration
+		if name == "file" {
+			maxAge = config.PortFileMaxAge
+		}
+		fb.entries = append(fb.entries, fallbackEntry{source: src, maxAge: maxAge, stats: &sourceMetrics{name: src.String()}})
+	}
+	return withPortRange(fb, config), nil
+}
+
+// setPortFile points every file source within source at path.
+func setPortFile(source PortSource, path string) {
+	switch s := source.(type) {
+	case *filePortSource:
+		s.path = path
+	case *fallbackPortSource:
+		for _, e := range s.entries {
+			setPortFile(e.source, path)
+		}
+	case *rangePortSource:
+		setPortFile(s.source, path)
+	}
+}
+
+func newSinglePortSource(name string, config *Config) (PortSource, error) {
+	switch name {
+	case "file":
+		return &filePortSource{path: config.PortFile, format: newPortFormat(config), lock: config.UseFileLock, clock: realClock{}}, nil
+	case "exec":
+		return &execPortSource{command: config.PortCmd, timeout: config.PortCmdTimeout, format: newPortFormat(config)}, nil
+	case "gluetun-api":
+		return newGluetunPortSource(config), nil
+	default:
+		return nil, fmt.Errorf("unknown port source %q", name)
+	}
+}
+
+// freshnessSource is implemented by sources that know when their value last
+// changed, so a fallbackPortSource can skip them once they go stale.
+type freshnessSource interface {
+	LastUpdated() (time.Time, error)
+}
+
+func (s *filePortSource) LastUpdated() (time.Time, error) {
+	path, err := s.resolve()
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+type fallbackEntry struct {
+	source PortSource
+	maxAge time.Duration // 0: never stale
+	stats  *sourceMetrics
+}
+
+// fallbackPortSource tries its sources in priority order and uses the first
+// one that is fresh and readable. The last source is used even when stale,
+// since an old port beats none.
+type fallbackPortSource struct {
+	entries []fallbackEntry
+	active  string
+}
+
+func (f *fallbackPortSource) GetPort(ctx context.Context) (int, error) {
+	var errs []error
+	for i, e := range f.entries {
+		last := i == len(f.entries)-1
+		if fs, ok := e.source.(freshnessSource); ok && e.maxAge > 0 {
+			if updated, err := fs.LastUpdated(); err == nil {
+				age := time.Since(updated)
+				stale := age > e.maxAge
+				e.stats.age.Store(int64(age.Seconds()))
+				wasStale := e.stats.stale.Swap(stale)
+				if stale && !wasStale {
+					slog.Warn("Port source is stale", "source", e.source.String(), "age", age.Round(time.Second), "max_age", e.maxAge)
+				} else if !stale && wasStale {
+					slog.Info("Port source is fresh again", "source", e.source.String())
+				}
+				if stale && !last {
+					errs = append(errs, fmt.Errorf("%s: stale (%v old)", e.source.String(), age.Round(time.Second)))
+					continue
+				}
+			}
+		}
+
+		port, err := e.source.GetPort(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.source.String(), err))
+			continue
+		}
+		if f.active != e.source.String() {
+			slog.Info("Using port source", "source", e.source.String(), "priority", i+1)
+			f.active = e.source.String()
+		}
+		return port, nil
+	}
+	return 0, errors.Join(errs...)
+}
+
+func (f *fallbackPortSource) String() string {
+	names := make([]string, len(f.entries))
+	for i, e := range f.entries {
+		names[i] = e.source.String()
+	}
+	return "fallback(" + strings.Join(names, ", ") + ")"
+}
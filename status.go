@@ -0,0 +1,74 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type statusResponse struct {
+	ClientType      string       `json:"client_type"`
+	Port            int          `json:"port"`
+	QBittorrentPort int          `json:"qbittorrent_port"`
+	LastSync        *time.Time   `json:"last_sync,omitempty"`
+	LastSuccess     *time.Time   `json:"last_success,omitempty"`
+	Syncs           int64        `json:"syncs"`
+	Errors          int64        `json:"errors"`
+	Uptime          string       `json:"uptime"`
+	LastError       *healthError `json:"last_error,omitempty"`
+	CircuitBreaker  string       `json:"circuit_breaker"`
+}
+
+func unixTime(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// handleStatus serves the sync state from the metrics and health state, which
+// are safe to read while a sync is running.
+func (s *Syncer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, statusResponse{
+		ClientType:      s.config.ClientType,
+		Port:            int(s.metrics.port.Load()),
+		QBittorrentPort: int(s.metrics.qbPort.Load()),
+		LastSync:        unixTime(s.metrics.lastSync.Load()),
+		LastSuccess:     unixTime(s.metrics.lastSuccess.Load()),
+		Syncs:           s.metrics.syncs.Load(),
+		Errors:          s.metrics.errors.Load(),
+		Uptime:          time.Since(s.startTime).Round(time.Second).String(),
+		LastError:       s.health.lastError(),
+		CircuitBreaker:  breakerState(s.metrics.breakersOpen.Load()),
+	})
+}
+
+func breakerState(open int64) string {
+	if open > 0 {
+		return "open"
+	}
+	return "closed"
+}
+
+func (s *Syncer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.events.recent())
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Syncer owns the state carried between sync cycles.
+type Syncer struct {
+	client   TorrentClient
+	source   PortSource
+	config   *Config
+	lastPort int
+
+	// forceWrite makes the next applyPort write even if qBittorrent already
+	// reports the port; set at startup by FORCE_WRITE_ON_START.
+	forceWrite bool
+
+	// verifyNext makes the next unchanged cycle compare against qBittorrent
+	// even without ALWAYS_VERIFY. It is set at startup and whenever
+	// qBittorrent was unreachable, since a restart or reinstall may have put
+	// it back on its default port.
+	verifyNext bool
+
+	// noPort is set while the source reports a "no port" sentinel, so the
+	// state is logged once instead of every tick.
+	noPort bool
+
+	// randomPortReported keeps the random-port guidance to one error per
+	// episode rather than one per tick.
+	randomPortReported bool
+
+	// lastContact is when qBittorrent last answered a port read, used to
+	// decide whether PREFLIGHT_AUTH_CHECK should check the session first.
+	lastContact time.Time
+
+	// unchanged counts consecutive checks that found the port as it was,
+	// and lastChange is when lastPort last moved; both feed the heartbeat.
+	unchanged  int
+	lastChange time.Time
+
+	// Heartbeat counters, reset every time a heartbeat is logged.
+	startTime  time.Time
+	syncCount  int
+	errorCount int
+	driftCount int
+
+	// Full-stack outage tracking: set when neither the port source nor
+	// qBittorrent can be reached, so we back off instead of logging both
+	// failures every tick.
+	stackDownSince time.Time
+	stackBackoff   time.Duration
+	nextAttempt    time.Time
+
+	// DNS failures for the qBittorrent host (typically a container that
+	// isn't up yet) back off separately; re-authenticating can't help.
+	dnsBackoff      time.Duration
+	dnsBackoffUntil time.Time
+
+	// breaker skips cycles while qBittorrent keeps failing; cycleFailed
+	// marks the current cycle as one that failed on a qBittorrent call.
+	breaker     *circuitBreaker
+	cycleFailed bool
+
+	clock clock
+
+	metrics *metrics
+	health  *healthState
+	events  *eventLog
+
+	// publisher is nil unless EVENT_SINK is set.
+	publisher *eventPublisher
+	// notifier is nil unless NOTIFY_URL is set.
+	notifier *notifier
+	// watchdog is nil unless running under systemd.
+	watchdog *watchdog
+
+	// Change hooks track the last port each one accepted, so a failed hook
+	// is retried on the next tick without re-running the others.
+	hooks     []changeHook
+	hookPorts []int
+}
+
+func NewSyncer(client TorrentClient, source PortSource, hooks []changeHook, config *Config) *Syncer {
+	s := &Syncer{
+		client:     client,
+		source:     source,
+		config:     config,
+		forceWrite: config.ForceWriteOnStart,
+		verifyNext: true,
+		startTime:  time.Now(),
+		metrics:    &metrics{},
+		health:     &healthState{},
+		events:     newEventLog(50),
+		hooks:      hooks,
+		hookPorts:  make([]int, len(hooks)),
+		notifier:   newNotifier(config),
+		watchdog:   newWatchdog(config),
+		clock:      realClock{},
+	}
+	s.breaker = newCircuitBreaker(config, &s.metrics.breakersOpen)
+	s.health.staleAfter.Store(int64(3 * config.CheckInterval))
+	if r, ok := source.(*rangePortSource); ok {
+		source = r.source
+	}
+	if fb, ok := source.(*fallbackPortSource); ok {
+		for _, e := range fb.entries {
+			s.metrics.sources = append(s.metrics.sources, e.stats)
+		}
+	}
+	return s
+}
+
+// readPort reads the port source, retrying transient failures within the
+// cycle, such as a gluetun control server that briefly refuses connections.
+func (s *Syncer) readPort(ctx context.Context) (int, error) {
+	var port int
+	policy := newBackoffPolicy(s.config)
+	policy.clock = s.clock
+	err := retryWithBackoff(ctx, policy, "read_port", func() error {
+		var err error
+		port, err = s.source.GetPort(ctx)
+		return err
+	})
+	return port, err
+}
+
+// lane returns a Syncer for another client and port source pair that
+// shares s's metrics, health, event log and notifications, as used by
+// PORT_FILE_SELECT=specific.
+func (s *Syncer) lane(client TorrentClient, source PortSource) *Syncer {
+	return &Syncer{
+		client:     client,
+		source:     source,
+		config:     s.config,
+		forceWrite: s.config.ForceWriteOnStart,
+		verifyNext: true,
+		startTime:  s.startTime,
+		metrics:    s.metrics,
+		health:     s.health,
+		events:     s.events,
+		publisher:  s.publisher,
+		notifier:   s.notifier,
+		watchdog:   s.watchdog,
+		hooks:      s.hooks,
+		hookPorts:  make([]int, len(s.hooks)),
+		breaker:    newCircuitBreaker(s.config, &s.metrics.breakersOpen),
+		clock:      s.clock,
+	}
+}
+
+// withoutShutdown detaches ctx from shutdown so a preferences write that has
+// started is allowed to finish, along with the checks that it took: an
+// interrupted setPreferences can leave qBittorrent half-configured. Any SYNC_TIMEOUT deadline still applies, and
+// the HTTP client's own timeout bounds the rest.
+func withoutShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return detached, func() {}
+}
+
+// finalSync runs one last sync-and-verify before exit so the port is known
+// to be correct, bounded by whatever is left of the shutdown grace period.
+func (s *Syncer) finalSync(deadline time.Time) {
+	if !s.clock.Now().Before(deadline) {
+		slog.Warn("Shutdown grace period already elapsed, skipping final sync")
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	slog.Info("Running final sync before exit...")
+	// Forget the cached port so the final sync always checks qBittorrent,
+	// and lift the backoffs and the breaker: this is the last chance.
+	s.lastPort = 0
+	if now := s.clock.Now(); s.inStackBackoff() || now.Before(s.dnsBackoffUntil) || s.breaker.blocking(now) {
+		slog.Info("Final sync ignores the current backoff")
+		s.nextAttempt = time.Time{}
+		s.dnsBackoffUntil = time.Time{}
+		s.breaker.nextProbe = time.Time{}
+	}
+	s.syncPort(ctx)
+
+	currentPort, err := s.client.GetListeningPort(ctx)
+	if err != nil {
+		slog.Error("Final state: unable to verify qBittorrent port", errAttrs(err)...)
+		return
+	}
+	filePort, err := s.source.GetPort(ctx)
+	if err != nil {
+		slog.Error("Final state: port source unreadable", "qbittorrent_port", currentPort, "source", s.source.String(), "error", err)
+		return
+	}
+	if currentPort != filePort {
+		slog.Warn("Final state: qBittorrent port does not match forwarded port", "qbittorrent_port", currentPort, "port", filePort)
+		return
+	}
+	slog.Info("Final state: qBittorrent listening on forwarded port", "port", currentPort)
+}
+
+// lastSyncErr reports why the most recent sync did not leave qBittorrent on
+// the forwarded port, for RUN_MODE=oneshot's exit status.
+func (s *Syncer) lastSyncErr() error {
+	if s.noPort {
+		return ErrNoPort
+	}
+	if lastErr := s.health.lastError(); lastErr != nil {
+		return errors.New(lastErr.Message)
+	}
+	if s.lastPort == 0 {
+		return errors.New("sync did not complete")
+	}
+	return nil
+}
+
+func (s *Syncer) syncPort(ctx context.Context) {
+	if now := s.clock.Now(); s.inStackBackoff() || now.Before(s.dnsBackoffUntil) || s.breaker.blocking(now) {
+		return
+	}
+	s.cycleFailed = false
+	defer func() {
+		if s.cycleFailed {
+			s.breaker.failed(s.client.String(), s.clock.Now())
+		}
+	}()
+	s.syncCount++
+	s.metrics.syncs.Add(1)
+	s.metrics.lastSync.Store(s.clock.Now().Unix())
+
+	// Read port from file
+	filePort, err := s.readPort(ctx)
+	if errors.Is(err, ErrNoPort) {
+		// Port 0 is routine while the VPN negotiates, so it stays at debug.
+		if errors.Is(err, errPortZero) {
+			slog.Debug("Port source reports port 0, waiting for a forwarded port", "source", s.source.String())
+		} else if !s.noPort {
+			slog.Info("No forwarded port available, waiting for one", "source", s.source.String(), "detail", err)
+		}
+		s.noPort = true
+		s.health.recordSync()
+		return
+	}
+	if errors.Is(err, ErrPortFileEmpty) {
+		slog.Debug("Port file is empty, waiting for it to be written", "source", s.source.String())
+		s.health.recordSync()
+		return
+	}
+	if s.noPort && err == nil {
+		slog.Info("Forwarded port available again", "port", filePort)
+		s.noPort = false
+	}
+	if err != nil {
+		if healthErr := s.client.CheckHealth(ctx); healthErr != nil {
+			s.markStackDown(err, healthErr)
+			s.fail(stageRead, categoryNetwork, errors.Join(err, healthErr))
+			return
+		}
+		s.markStackUp()
+		slog.Error("Error reading port", "source", s.source.String(), "error", err)
+		s.fail(stageRead, categoryFile, err)
+		return
+	}
+	s.markStackUp()
+
+	// Check if port has changed
+	if filePort == s.lastPort {
+		if !s.config.AlwaysVerify && !s.verifyNext {
+			s.unchanged++
+			slog.Debug("Port unchanged", "port", filePort, "unchanged_checks", s.unchanged)
+			s.runHooks(ctx, filePort)
+			s.succeeded(filePort)
+			return
+		}
+		currentPort, ok := s.getCurrentPort(ctx)
+		if !ok {
+			return
+		}
+		s.verifyNext = s.instancesMissing()
+		if currentPort == filePort {
+			s.unchanged++
+			slog.Debug("Port unchanged", "port", filePort, "unchanged_checks", s.unchanged)
+			s.runHooks(ctx, filePort)
+			s.succeeded(filePort)
+			return
+		}
+		// The forwarded port did not move but qBittorrent's did, so
+		// something other than us changed it.
+		s.driftCount++
+		s.metrics.drift.Add(1)
+		slog.Warn("Drift detected: qBittorrent port changed while the forwarded port did not; another tool may be changing it, reconciling...",
+			"qbittorrent_port", currentPort, "port", filePort)
+		s.events.add("drift", fmt.Sprintf("qBittorrent was on port %d instead of %d", currentPort, filePort), filePort)
+		s.applyPort(ctx, filePort, currentPort)
+		return
+	}
+
+	// A changed port usually means the VPN just reconnected; give the tunnel
+	// time to settle before touching qBittorrent. Not needed on first sync.
+	// The port is only applied if it is the same after the delay: gluetun can
+	// write an old port and then the new one while reconnecting, and the
+	// write that changed it again starts a fresh delay on the next check.
+	if s.config.ApplyDelay > 0 && s.lastPort != 0 {
+		slog.Info("Port changed, waiting for VPN tunnel to settle...", "previous_port", s.lastPort, "port", filePort, "delay", s.config.ApplyDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(s.config.ApplyDelay):
+		}
+
+		settledPort, err := s.readPort(ctx)
+		if errors.Is(err, ErrNoPort) {
+			slog.Info("Forwarded port went away during apply delay", "source", s.source.String())
+			return
+		}
+		if err != nil {
+			slog.Error("Error re-reading port after apply delay", "source", s.source.String(), "error", err)
+			s.fail(stageRead, categoryFile, err)
+			return
+		}
+		if settledPort == s.lastPort {
+			slog.Info("Port reverted during apply delay, nothing to do", "port", settledPort)
+			return
+		}
+		if settledPort != filePort {
+			slog.Info("Port changed again during apply delay, waiting for it to settle", "previous_port", filePort, "port", settledPort)
+			return
+		}
+	}
+
+	slog.Info("Port changed, updating qBittorrent...", "previous_port", s.lastPort, "port", filePort)
+
+	// lastPort is left untouched, so the change is retried on the next tick.
+	if s.config.CheckHealthBeforeSet {
+		if err := s.client.CheckHealth(ctx); err != nil {
+			slog.Warn("qBittorrent is not responding, deferring port change to next check", errAttrs(err)...)
+			return
+		}
+	}
+
+	currentPort, ok := s.getCurrentPort(ctx)
+	if !ok {
+		return
+	}
+
+	slog.Info("qBittorrent current port", "qbittorrent_port", currentPort)
+
+	s.applyPort(ctx, filePort, currentPort)
+}
+
+// getCurrentPort fetches qBittorrent's listening port, re-authenticating once
+// if the session expired. Failures are logged and counted.
+func (s *Syncer) getCurrentPort(ctx context.Context) (int, bool) {
+	s.preflight(ctx)
+
+	currentPort, err := s.client.GetListeningPort(ctx)
+	if err != nil {
+		if errors.Is(err, ErrAuthExpired) {
+			slog.Info("Session expired, re-authenticating...")
+			if err := s.client.Login(ctx); err != nil {
+				s.clientFailed(stageLogin, "Re-authentication failed", err)
+				return 0, false
+			}
+			// Retry getting current port
+			currentPort, err = s.client.GetListeningPort(ctx)
+			if err != nil {
+				s.clientFailed(stageGet, "Failed to get current port after re-auth", err)
+				return 0, false
+			}
+		} else {
+			s.clientFailed(stageGet, "Failed to get current port", err)
+			return 0, false
+		}
+	}
+	s.dnsBackoff = 0
+	s.lastContact = s.clock.Now()
+	s.metrics.qbPort.Store(int64(currentPort))
+	return currentPort, true
+}
+
+// checkAuth makes a cheap authenticated call so revoked credentials show up
+// on /healthz between port changes instead of at the next change.
+func (s *Syncer) checkAuth(ctx context.Context) {
+	err := s.client.CheckSession(ctx)
+	if err == nil {
+		s.lastContact = s.clock.Now()
+		return
+	}
+	if !errors.Is(err, ErrAuthExpired) {
+		s.clientFailed(stageLogin, "Auth health check failed", err)
+		return
+	}
+
+	slog.Info("Session expired (auth health check), re-authenticating...")
+	if err := s.client.Login(ctx); err != nil {
+		s.clientFailed(stageLogin, "Auth health check: re-authentication failed", err)
+		return
+	}
+	s.lastContact = s.clock.Now()
+}
+
+// preflightIdle is how long qBittorrent must have gone unqueried before
+// PREFLIGHT_AUTH_CHECK bothers checking the session.
+const preflightIdle = 5 * time.Minute
+
+// preflight re-authenticates ahead of the real requests when the session is
+// likely to have expired since we last talked to qBittorrent. Failures are
+// left for the real requests to report.
+func (s *Syncer) preflight(ctx context.Context) {
+	if !s.config.PreflightAuthCheck || s.clock.Now().Sub(s.lastContact) < preflightIdle {
+		return
+	}
+	err := s.client.CheckSession(ctx)
+	if err == nil || !errors.Is(err, ErrAuthExpired) {
+		return
+	}
+	slog.Info("Session expired (preflight), re-authenticating...")
+	if err := s.client.Login(ctx); err != nil {
+		slog.Warn("Preflight re-authentication failed", errAttrs(err)...)
+	}
+}
+
+// applyPort sets filePort on qBittorrent unless it already reports it, and
+// records it as the last applied port on success.
+func (s *Syncer) applyPort(ctx context.Context, filePort, currentPort int) {
+	forced := s.forceWrite && currentPort == filePort
+	if forced {
+		slog.Info("qBittorrent already reports port, forcing a write anyway (FORCE_WRITE_ON_START)", "port", filePort)
+	}
+
+	if (currentPort != filePort || forced) && !s.applyAllowed(ctx) {
+		return
+	}
+
+	// Dry run: everything up to the write is exercised, but nothing is sent
+	// to qBittorrent. A full dry run also builds and checks the exact payload.
+	if s.config.DryRun && (currentPort != filePort || forced) {
+		attrs := []any{"qbittorrent_port", currentPort, "port", filePort}
+		if s.config.DryRunFull {
+			payload, err := s.client.ValidateSetPayload(filePort)
+			if err != nil {
+				slog.Error("[dry-run] setPreferences payload failed validation", "port", filePort, "error", err)
+				s.fail(stageSet, categoryQBittorrent, err)
+				return
+			}
+			attrs = append(attrs, "payload", payload)
+		}
+		slog.Info("[dry-run] Would set qBittorrent listening port", attrs...)
+		s.forceWrite = false
+		s.setLastPort(filePort)
+		s.runHooks(ctx, filePort)
+		return
+	}
+
+	// Update if different
+	if currentPort != filePort || forced {
+		setCtx, cancel := withoutShutdown(ctx)
+		defer cancel()
+		if err := s.client.SetListeningPort(setCtx, filePort); err != nil {
+			if errors.Is(err, ErrAuthExpired) {
+				slog.Info("Session expired during set, re-authenticating...")
+				if err := s.client.Login(setCtx); err != nil {
+					s.clientFailed(stageLogin, "Re-authentication failed", err)
+					return
+				}
+				// Retry setting port
+				if err := s.client.SetListeningPort(setCtx, filePort); err != nil {
+					s.clientFailed(stageSet, "Failed to set port after re-auth", err)
+					return
+				}
+			} else {
+				s.clientFailed(stageSet, "Failed to set listening port", err)
+				return
+			}
+		}
+		if !s.verifyApplied(setCtx, filePort) {
+			return
+		}
+		if s.config.ConfirmBind {
+			if err := s.confirmBind(setCtx, filePort); err != nil {
+				s.clientFailed(stageSet, "qBittorrent accepted the port but did not confirm the bind, will retry", err)
+				return
+			}
+		}
+		if forced {
+			slog.Info("✓ Forced write of qBittorrent listening port", "port", filePort)
+		} else {
+			slog.Info("✓ Successfully updated qBittorrent listening port", "port", filePort)
+		}
+		s.forceWrite = false
+		s.metrics.portUpdates.Add(1)
+		s.writeReport(ctx, currentPort, filePort, s.config.ConfirmBind)
+		s.events.add("change", fmt.Sprintf("Listening port updated from %d to %d", currentPort, filePort), filePort)
+		s.publisher.publish(filePort, currentPort)
+		s.notifier.notify(ctx, filePort, currentPort)
+	} else {
+		slog.Info("qBittorrent already configured with correct port", "port", filePort)
+	}
+
+	s.setLastPort(filePort)
+	s.verifyNext = s.verifyNext || s.instancesMissing()
+	s.runHooks(ctx, filePort)
+	s.succeeded(filePort)
+}
+
+// verifyApplied re-reads the listening port after a write. qBittorrent
+// answers 200 even when it ignores the value, most commonly because "Use
+// random port" is on, so without this we would report a change that never
+// happened. lastPort is left alone on a mismatch so the next tick tries again.
+func (s *Syncer) verifyApplied(ctx context.Context, port int) bool {
+	current, err := s.client.GetListeningPort(ctx)
+	if err != nil {
+		s.clientFailed(stageSet, "Failed to read back listening port after set", err)
+		return false
+	}
+	if current == port {
+		s.randomPortReported = false
+		return true
+	}
+
+	err = fmt.Errorf("client reports port %d after being set to %d", current, port)
+	if prefs, prefsErr := s.client.GetPreferencesRaw(ctx); prefsErr == nil && randomPortEnabled(prefs) {
+		if !s.randomPortReported {
+			slog.Error("Random listening port is enabled, so the forwarded port is ignored; disable \"Use different port on each startup\" (random_port) in the client",
+				"port", port, "qbittorrent_port", current)
+			s.randomPortReported = true
+		}
+		s.fail(stageSet, categoryQBittorrent, fmt.Errorf("%w (random port enabled)", err))
+		return false
+	}
+	slog.Warn("Listening port did not take effect, will retry", "port", port, "qbittorrent_port", current)
+	s.fail(stageSet, categoryQBittorrent, err)
+	return false
+}
+
+// randomPortEnabled looks for the random_port preference, which qBittorrent
+// and Deluge both use.
+func randomPortEnabled(prefs []byte) bool {
+	var p struct {
+		RandomPort bool `json:"random_port"`
+	}
+	return json.Unmarshal(prefs, &p) == nil && p.RandomPort
+}
+
+// confirmBind polls qBittorrent after a write until it reports the new port
+// and is not disconnected, so the success log reflects the listener rather
+// than just the API accepting the request.
+func (s *Syncer) confirmBind(ctx context.Context, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.ConfirmBindWait)
+	defer cancel()
+
+	var lastErr error
+	for {
+		current, err := s.client.GetListeningPort(ctx)
+		if err == nil && current != port {
+			err = fmt.Errorf("qBittorrent reports port %d", current)
+		}
+		if err == nil {
+			var status string
+			status, err = s.client.ConnectionStatus(ctx)
+			if err == nil && status == "disconnected" {
+				err = errors.New("qBittorrent connection status is disconnected")
+			}
+			if err == nil {
+				slog.Info("qBittorrent confirmed listening port", "port", port, "connection_status", status)
+				return nil
+			}
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("bind not confirmed within %v: %w", s.config.ConfirmBindWait, lastErr)
+		case <-s.clock.After(time.Second):
+		}
+	}
+}
+
+// Values for APPLY_WHEN.
+const (
+	applyAlways    = "always"
+	applyHasActive = "has_active"
+	applyNoActive  = "no_active"
+)
+
+// applyAllowed reports whether APPLY_WHEN lets a write happen right now. A
+// deferred write leaves lastPort alone, so it is retried on the next tick.
+func (s *Syncer) applyAllowed(ctx context.Context) bool {
+	if s.config.ApplyWhen == applyAlways {
+		return true
+	}
+
+	active, err := s.client.CountActiveTorrents(ctx)
+	if err != nil {
+		s.clientFailed(stageGet, "Failed to count active torrents, deferring port change", err)
+		return false
+	}
+
+	allowed := active > 0
+	if s.config.ApplyWhen == applyNoActive {
+		allowed = active == 0
+	}
+	if !allowed {
+		slog.Info("Deferring port change until torrent activity matches APPLY_WHEN", "apply_when", s.config.ApplyWhen, "active_torrents", active)
+		return false
+	}
+	slog.Info("Torrent activity allows port change", "apply_when", s.config.ApplyWhen, "active_torrents", active)
+	return true
+}
+
+// runHooks tells every change hook about port if it hasn't accepted it yet.
+// It runs once port has settled through APPLY_DELAY and APPLY_WHEN and is on
+// qBittorrent; a hook that failed is retried on the following checks.
+func (s *Syncer) runHooks(ctx context.Context, port int) {
+	for i, hook := range s.hooks {
+		previous := s.hookPorts[i]
+		if previous == port {
+			continue
+		}
+		if s.config.DryRun {
+			slog.Info("[dry-run] Would run change hook", "hook", hook.String(), "port", port, "previous_port", previous)
+			s.hookPorts[i] = port
+			continue
+		}
+		if err := hook.Run(ctx, port, previous); err != nil {
+			slog.Error("Change hook failed, will retry", "hook", hook.String(), "port", port, "error", err)
+			s.events.add("hook", hook.String()+" failed: "+err.Error(), port)
+			s.countError(stageHook)
+			continue
+		}
+		slog.Info("✓ Change hook ran", "hook", hook.String(), "port", port, "previous_port", previous)
+		s.events.add("hook", hook.String()+" ran", port)
+		s.hookPorts[i] = port
+	}
+}
+
+// instancesMissing reports whether one of several QBITTORRENT_URL instances
+// was unreachable on the last read. Unchanged cycles keep checking until it
+// is back, so it is brought onto the port even though lastPort has moved on.
+func (s *Syncer) instancesMissing() bool {
+	m, ok := s.client.(*multiClient)
+	return ok && m.missing()
+}
+
+func (s *Syncer) countError(stage errorStage) {
+	s.errorCount++
+	s.metrics.errors.Add(1)
+	s.metrics.stageErrors[stage].Add(1)
+	if stage == stageLogin {
+		s.metrics.loginFailures.Add(1)
+	}
+}
+
+// fail counts err and reports it on /healthz until the next success.
+// Together with succeeded and the no-port paths in syncPort it marks a
+// completed check for /healthz's staleness limit; cycles skipped by a backoff
+// or the breaker do not.
+func (s *Syncer) fail(stage errorStage, category string, err error) {
+	s.countError(stage)
+	s.health.recordError(category, err)
+	s.health.recordSync()
+	s.events.add("error", category+": "+err.Error(), 0)
+	s.watchdog.failed()
+}
+
+func (s *Syncer) succeeded(port int) {
+	s.metrics.recordSuccess(port)
+	s.health.recordSuccess()
+	s.health.recordSync()
+	s.watchdog.succeeded()
+	s.breaker.succeeded(s.client.String(), s.clock.Now())
+}
+
+// clientFailed logs and counts a failed qBittorrent call. DNS resolution
+// failures get their own message and back off instead of retrying every tick.
+func (s *Syncer) clientFailed(stage errorStage, msg string, err error) {
+	category := classifyError(err)
+	s.fail(stage, category, err)
+	s.cycleFailed = true
+	if category == categoryNetwork {
+		s.verifyNext = true
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		slog.Error(msg, append(errAttrs(err), "stage", stage.String())...)
+		return
+	}
+
+	if s.dnsBackoff == 0 {
+		s.dnsBackoff = s.config.CheckInterval
+	} else {
+		s.dnsBackoff *= 2
+	}
+	if s.dnsBackoff > s.config.DNSMaxBackoff {
+		s.dnsBackoff = s.config.DNSMaxBackoff
+	}
+	s.dnsBackoffUntil = s.clock.Now().Add(s.dnsBackoff)
+	slog.Warn("qBittorrent host not resolvable yet, backing off", "host", dnsErr.Name, "retry_in", s.dnsBackoff, "error", dnsErr.Err)
+}
+
+func (s *Syncer) inStackBackoff() bool {
+	return !s.stackDownSince.IsZero() && s.clock.Now().Before(s.nextAttempt)
+}
+
+func (s *Syncer) markStackDown(sourceErr, clientErr error) {
+	if s.stackDownSince.IsZero() {
+		s.stackDownSince = s.clock.Now()
+		s.stackBackoff = 2 * s.config.CheckInterval
+		slog.Error("Stack appears down, backing off", "source_error", sourceErr, "qbittorrent_error", clientErr)
+		s.verifyNext = true
+	} else {
+		s.stackBackoff *= 2
+	}
+	if s.stackBackoff > s.config.StackDownMaxBackoff {
+		s.stackBackoff = s.config.StackDownMaxBackoff
+	}
+	s.nextAttempt = s.clock.Now().Add(s.stackBackoff)
+}
+
+func (s *Syncer) markStackUp() {
+	if s.stackDownSince.IsZero() {
+		return
+	}
+	slog.Info("Stack recovered", "down_for", s.clock.Now().Sub(s.stackDownSince).Round(time.Second))
+	s.stackDownSince = time.Time{}
+	s.stackBackoff = 0
+	s.nextAttempt = time.Time{}
+}
+
+// setLastPort records port as applied; a different port restarts the
+// unchanged streak.
+func (s *Syncer) setLastPort(port int) {
+	if port != s.lastPort {
+		s.unchanged = 0
+		s.lastChange = s.clock.Now()
+	}
+	s.lastPort = port
+}
+
+// startupSummary is logged once after the initial sync. From then on
+// unchanged checks only show at debug level, so this and the heartbeat are
+// what says the service is alive.
+func (s *Syncer) startupSummary() {
+	attrs := []any{"port", s.lastPort, "client", s.client.String(), "source", s.source.String(), "check_interval", s.config.CheckInterval}
+	if s.config.HeartbeatInterval > 0 {
+		attrs = append(attrs, "heartbeat_interval", s.config.HeartbeatInterval)
+	}
+	if err := s.health.lastError(); err != nil {
+		attrs = append(attrs, "last_error", err.Message)
+	}
+	slog.Info("Initial sync done, unchanged checks are logged at debug level", attrs...)
+}
+
+// heartbeat logs a one-line summary of activity since the previous heartbeat.
+func (s *Syncer) heartbeat() {
+	lastChange := "never"
+	if !s.lastChange.IsZero() {
+		lastChange = s.clock.Now().Sub(s.lastChange).Round(time.Second).String() + " ago"
+	}
+	slog.Info("Heartbeat", "client", s.client.String(), "port", s.lastPort, "last_change", lastChange, "unchanged_checks", s.unchanged,
+		"syncs", s.syncCount, "errors", s.errorCount, "drift", s.driftCount, "uptime", s.clock.Now().Sub(s.startTime).Round(time.Second))
+	s.syncCount = 0
+	s.errorCount = 0
+	s.driftCount = 0
+}
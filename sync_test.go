@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestSyncer wires a Syncer to qb and a port file in a temporary
+// directory, on a fake clock. It does not log in first, just as the sync
+// loop may find the session gone.
+func newTestSyncer(t testing.TB, qb *fakeQBittorrent, env map[string]string) (*Syncer, string, *fakeClock) {
+	t.Helper()
+	portFile := filepath.Join(t.TempDir(), "forwarded_port")
+	if env == nil {
+		env = map[string]string{}
+	}
+	env["PORT_FILE"] = portFile
+	config := testConfig(t, qb.URL, env)
+
+	client, err := newTorrentClient(config)
+	if err != nil {
+		t.Fatalf("newTorrentClient: %v", err)
+	}
+	source, err := newPortSource(config)
+	if err != nil {
+		t.Fatalf("newPortSource: %v", err)
+	}
+	s := NewSyncer(client, source, nil, config)
+	clk := newFakeClock()
+	s.clock = clk
+	return s, portFile, clk
+}
+
+func writePort(t testing.TB, path string, port int) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strconv.Itoa(port)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncAppliesForwardedPort(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, _ := newTestSyncer(t, qb, nil)
+	writePort(t, portFile, 51413)
+
+	s.syncPort(context.Background())
+
+	if got := qb.listenPort(); got != 51413 {
+		t.Fatalf("qBittorrent listen_port = %d, want 51413", got)
+	}
+	if s.lastPort != 51413 {
+		t.Errorf("lastPort = %d, want 51413", s.lastPort)
+	}
+	if s.health.lastError() != nil {
+		t.Errorf("health reports %v after a successful sync", s.health.lastError())
+	}
+}
+
+func TestSyncLogsInAgainAfterSessionExpires(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, _ := newTestSyncer(t, qb, nil)
+	ctx := context.Background()
+	writePort(t, portFile, 51413)
+	s.syncPort(ctx)
+	if got := qb.loginCount(); got != 1 {
+		t.Fatalf("logins after first sync = %d, want 1", got)
+	}
+
+	qb.expireSession()
+	writePort(t, portFile, 51414)
+	s.syncPort(ctx)
+
+	if got := qb.loginCount(); got != 2 {
+		t.Errorf("logins = %d, want 2 (re-login after 403)", got)
+	}
+	if got := qb.listenPort(); got != 51414 {
+		t.Errorf("qBittorrent listen_port = %d, want 51414", got)
+	}
+}
+
+func TestSyncWaitsForPortToSettle(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, clk := newTestSyncer(t, qb, map[string]string{"APPLY_DELAY": "10s"})
+	ctx := context.Background()
+	writePort(t, portFile, 51413)
+	s.syncPort(ctx)
+
+	writePort(t, portFile, 51414)
+	done := make(chan struct{})
+	go func() {
+		s.syncPort(ctx)
+		close(done)
+	}()
+	clk.blockUntil(t, 1)
+	if got := qb.listenPort(); got != 51413 {
+		t.Fatalf("port applied before APPLY_DELAY elapsed: listen_port = %d", got)
+	}
+	clk.Advance(10 * time.Second)
+	<-done
+
+	if got := qb.listenPort(); got != 51414 {
+		t.Errorf("qBittorrent listen_port = %d, want 51414", got)
+	}
+}
+
+func TestSyncIgnoresPortThatRevertsDuringApplyDelay(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, clk := newTestSyncer(t, qb, map[string]string{"APPLY_DELAY": "10s"})
+	ctx := context.Background()
+	writePort(t, portFile, 51413)
+	s.syncPort(ctx)
+
+	writePort(t, portFile, 51414)
+	done := make(chan struct{})
+	go func() {
+		s.syncPort(ctx)
+		close(done)
+	}()
+	clk.blockUntil(t, 1)
+	writePort(t, portFile, 51413)
+	clk.Advance(10 * time.Second)
+	<-done
+
+	if len(qb.sets) != 1 {
+		t.Errorf("setPreferences calls = %d, want 1", len(qb.sets))
+	}
+	if got := qb.listenPort(); got != 51413 {
+		t.Errorf("qBittorrent listen_port = %d, want 51413", got)
+	}
+}
+
+func TestCircuitBreakerSkipsCyclesUntilProbe(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, clk := newTestSyncer(t, qb, map[string]string{"BREAKER_THRESHOLD": "2", "BREAKER_INTERVAL": "1m"})
+	ctx := context.Background()
+	writePort(t, portFile, 51413)
+	qb.Close()
+
+	s.syncPort(ctx)
+	s.syncPort(ctx)
+	if s.metrics.breakersOpen.Load() != 1 {
+		t.Fatalf("breaker not open after %d failed cycles", s.metrics.syncs.Load())
+	}
+
+	s.syncPort(ctx)
+	if got := s.metrics.syncs.Load(); got != 2 {
+		t.Errorf("syncs = %d while the breaker is open, want 2", got)
+	}
+
+	clk.Advance(time.Minute)
+	s.syncPort(ctx)
+	if got := s.metrics.syncs.Load(); got != 3 {
+		t.Errorf("syncs = %d after BREAKER_INTERVAL, want 3 (one probe)", got)
+	}
+}
+
+func TestSyncTreatsSentinelAsNoPort(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, _ := newTestSyncer(t, qb, nil)
+	ctx := context.Background()
+
+	for _, content := range []string{"none\n", "0\n"} {
+		if err := os.WriteFile(portFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s.syncPort(ctx)
+		if !s.noPort || s.errorCount != 0 || s.health.lastError() != nil {
+			t.Errorf("port file %q: noPort = %v, errors = %d, health = %v; want a quiet wait", content, s.noPort, s.errorCount, s.health.lastError())
+		}
+	}
+
+	if err := os.WriteFile(portFile, []byte("garbage\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.syncPort(ctx)
+	if s.errorCount != 1 || s.health.lastError() == nil {
+		t.Errorf("garbage port file: errors = %d, health = %v; want a reported error", s.errorCount, s.health.lastError())
+	}
+	if got := qb.listenPort(); got != 6881 {
+		t.Errorf("qBittorrent listen_port = %d, want it untouched", got)
+	}
+}
+
+func TestHealthzStaysHealthyWhileWaitingForPort(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	s, portFile, _ := newTestSyncer(t, qb, nil)
+	ctx := context.Background()
+	writePort(t, portFile, 51413)
+	s.syncPort(ctx)
+
+	// /healthz measures staleness on the wall clock, so shrink the limit
+	// instead of waiting out 3×CHECK_INTERVAL.
+	const staleAfter = 20 * time.Millisecond
+	s.health.staleAfter.Store(int64(staleAfter))
+	for _, content := range []string{"0\n", ""} {
+		if err := os.WriteFile(portFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(3 * staleAfter); time.Now().Before(deadline); {
+			time.Sleep(staleAfter / 4)
+			s.syncPort(ctx)
+		}
+		rec := httptest.NewRecorder()
+		s.health.handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("port file %q: /healthz = %d after waiting past the staleness limit, want 200:\n%s", content, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSyncReportsRejectedPreferences(t *testing.T) {
+	qb := newFakeQBittorrent(t)
+	qb.setReply = "Invalid value for listen_port"
+	s, portFile, _ := newTestSyncer(t, qb, nil)
+	writePort(t, portFile, 51413)
+
+	s.syncPort(context.Background())
+
+	if s.lastPort != 0 {
+		t.Errorf("lastPort = %d after a rejected write, want 0 so the next check retries", s.lastPort)
+	}
+	if s.health.lastError() == nil {
+		t.Error("rejected write not reported on /healthz")
+	}
+}
+
+// BenchmarkSyncPort measures a steady-state check with ALWAYS_VERIFY: read
+// the port file, fetch qBittorrent's preferences, find nothing to do.
+func BenchmarkSyncPort(b *testing.B) {
+	qb := newFakeQBittorrent(b)
+	padPreferences(qb)
+	s, portFile, _ := newTestSyncer(b, qb, map[string]string{"ALWAYS_VERIFY": "true"})
+	ctx := context.Background()
+	writePort(b, portFile, 51413)
+	s.syncPort(ctx)
+	if s.lastPort != 51413 {
+		b.Fatalf("lastPort = %d after the first sync, want 51413", s.lastPort)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.syncPort(ctx)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const transmissionSessionHeader = "X-Transmission-Session-Id"
+
+// TransmissionClient talks to the Transmission RPC endpoint. Authentication
+// is HTTP basic auth on every request; the only session state is the CSRF
+// token, which the server hands out in a 409 and rotates whenever it likes.
+type TransmissionClient struct {
+	rpcURL     string
+	username   string
+	password   string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+func NewTransmissionClient(rpcURL string, transport http.RoundTripper, config *Config) *TransmissionClient {
+	return &TransmissionClient{
+		rpcURL:     rpcURL,
+		username:   config.TransmissionUsername,
+		password:   config.TransmissionPassword,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+type transmissionRequest struct {
+	Method    string `json:"method"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// call runs one RPC method and decodes its arguments into out, repeating the
+// request once if the server asks for a fresh session id.
+func (c *TransmissionClient) call(ctx context.Context, method string, args, out any) error {
+	body, err := json.Marshal(transmissionRequest{Method: method, Arguments: args})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.rpcURL, bytes.NewReader(body))
+		if err != nil {
+			return newAPIError(method, c.rpcURL, 0, err, "failed to create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.username != "" || c.password != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		c.mu.Lock()
+		if c.sessionID != "" {
+			req.Header.Set(transmissionSessionHeader, c.sessionID)
+		}
+		c.mu.Unlock()
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return newAPIError(method, c.rpcURL, 0, err, "request failed")
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to read response")
+		}
+
+		switch resp.StatusCode {
+		case http.StatusConflict:
+			id := resp.Header.Get(transmissionSessionHeader)
+			if id == "" || attempt > 0 {
+				return newAPIError(method, c.rpcURL, resp.StatusCode, nil, "session id handshake failed")
+			}
+			c.mu.Lock()
+			c.sessionID = id
+			c.mu.Unlock()
+			continue
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return newAPIError(method, c.rpcURL, resp.StatusCode, ErrInvalidCredentials, "rpc request rejected")
+		case http.StatusOK:
+		default:
+			return newAPIError(method, c.rpcURL, resp.StatusCode, nil, fmt.Sprintf("unexpected status code: %d", resp.StatusCode))
+		}
+
+		var result transmissionResponse
+		if err := json.Unmarshal(data, &result); err != nil {
+			return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to decode response")
+		}
+		if result.Result != "success" {
+			return newAPIError(method, c.rpcURL, resp.StatusCode, nil, "rpc error: "+result.Result)
+		}
+		if out != nil {
+			if err := json.Unmarshal(result.Arguments, out); err != nil {
+				return newAPIError(method, c.rpcURL, resp.StatusCode, err, "failed to decode arguments")
+			}
+		}
+		return nil
+	}
+}
+
+// Login fetches a session id and checks the credentials with a cheap
+// session-get.
+func (c *TransmissionClient) Login(ctx context.Context) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+	slog.Info("Successfully authenticated with Transmission")
+	return nil
+}
+
+// CheckHealth only needs the server to answer; a 409 or 401 still proves
+// the RPC endpoint is up.
+func (c *TransmissionClient) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.rpcURL, nil)
+	if err != nil {
+		return newAPIError("health", c.rpcURL, 0, err, "failed to create request")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return newAPIError("health", c.rpcURL, 0, err, "rpc request failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return newAPIError("health", c.rpcURL, resp.StatusCode, nil, fmt.Sprintf("unexpected status code: %d", resp.StatusCode))
+	}
+	return nil
+}
+
+func (c *TransmissionClient) CheckSession(ctx context.Context) error {
+	_, err := c.Version(ctx)
+	return err
+}
+
+func (c *TransmissionClient) GetListeningPort(ctx context.Context) (int, error) {
+	var session struct {
+		PeerPort *int `json:"peer-port"`
+	}
+	if err := c.call(ctx, "session-get", map[string]any{"fields": []string{"peer-port"}}, &session); err != nil {
+		return 0, err
+	}
+	if session.PeerPort == nil {
+		return 0, newAPIError("session-get", c.rpcURL, http.StatusOK, nil, "peer-port missing from session")
+	}
+	return *session.PeerPort, nil
+}
+
+func (c *TransmissionClient) SetListeningPort(ctx context.Context, port int) error {
+	return c.call(ctx, "session-set", map[string]int{"peer-port": port}, nil)
+}
+
+func (c *TransmissionClient) ValidateSetPayload(port int) (string, error) {
+	body, err := json.Marshal(transmissionRequest{Method: "session-set", Arguments: map[string]int{"peer-port": port}})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (c *TransmissionClient) CountActiveTorrents(ctx context.Context) (int, error) {
+	var stats struct {
+		ActiveTorrentCount int `json:"activeTorrentCount"`
+	}
+	if err := c.call(ctx, "session-stats", nil, &stats); err != nil {
+		return 0, err
+	}
+	return stats.ActiveTorrentCount, nil
+}
+
+// ConnectionStatus maps Transmission's port-test onto qBittorrent's terms:
+// "connected" when the peer port is reachable, "firewalled" when not.
+func (c *TransmissionClient) ConnectionStatus(ctx context.Context) (string, error) {
+	var test struct {
+		PortIsOpen bool `json:"port-is-open"`
+	}
+	if err := c.call(ctx, "port-test", nil, &test); err != nil {
+		return "", err
+	}
+	if test.PortIsOpen {
+		return "connected", nil
+	}
+	return "firewalled", nil
+}
+
+func (c *TransmissionClient) Version(ctx context.Context) (string, error) {
+	var session struct {
+		Version string `json:"version"`
+	}
+	if err := c.call(ctx, "session-get", map[string]any{"fields": []string{"version"}}, &session); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(session.Version), nil
+}
+
+// GetPreferencesRaw returns the full session-get arguments.
+func (c *TransmissionClient) GetPreferencesRaw(ctx context.Context) ([]byte, error) {
+	var args json.RawMessage
+	if err := c.call(ctx, "session-get", nil, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// SetPreferencesRaw sends prefs as session-set arguments. Read-only keys
+// from a session-get snapshot are ignored by the server.
+func (c *TransmissionClient) SetPreferencesRaw(ctx context.Context, prefs []byte) error {
+	return c.call(ctx, "session-set", json.RawMessage(prefs), nil)
+}
+
+func (c *TransmissionClient) String() string {
+	return redactURL(c.rpcURL)
+}
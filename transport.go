@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Values for HTTP_TRANSPORT.
+const (
+	transportShared      = "shared"
+	transportPerInstance = "per_instance"
+)
+
+// newTransport returns a connection pool bounded by HTTP_MAX_CONNS_PER_HOST
+// and HTTP_MAX_IDLE_CONNS. With HTTP_TRANSPORT=per_instance every qBittorrent
+// address gets its own, so one misbehaving instance can't hold connections
+// the others need. Each request is limited to REQUEST_TIMEOUT.
+func newTransport(config *Config) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = config.MaxConnsPerHost
+	t.MaxIdleConns = config.MaxIdleConns
+	t.MaxIdleConnsPerHost = min(config.MaxConnsPerHost, config.MaxIdleConns)
+	t.IdleConnTimeout = 90 * time.Second
+	// The cloned transport already honours HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY; QBITTORRENT_PROXY overrides them for every request.
+	if config.ProxyURL != nil {
+		t.Proxy = http.ProxyURL(config.ProxyURL)
+	}
+	if config.TLSInsecure || config.TLSRootCAs != nil {
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: config.TLSInsecure,
+			RootCAs:            config.TLSRootCAs,
+		}
+	}
+	return &timeoutTransport{next: t, timeout: config.RequestTimeout}
+}
+
+// timeoutTransport gives every request its own deadline, layered on the
+// caller's context so shutdown still cancels it. Unlike http.Client.Timeout,
+// it applies per hop when a client follows redirects itself. The deadline
+// covers reading the body and is released when the body is closed.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// headerTransport adds AUTH_HEADER_NAME to every request for AUTH_MODE=header.
+// Sitting below the http.Client, it covers every request, redirects and
+// retries included, but only those to the configured host: a redirect to
+// another host never sees the header.
+type headerTransport struct {
+	next  http.RoundTripper
+	host  atomic.Pointer[string] // moves with an HTTPS upgrade
+	name  string
+	value string
+}
+
+func newHeaderTransport(next http.RoundTripper, host, name, value string) *headerTransport {
+	t := &headerTransport{next: next, name: name, value: value}
+	t.host.Store(&host)
+	return t
+}
+
+// setHost moves the header to host, for when the client follows qBittorrent
+// to its HTTPS port.
+func (t *headerTransport) setHost(host string) {
+	t.host.Store(&host)
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if strings.EqualFold(req.URL.Host, *t.host.Load()) {
+		req.Header.Set(t.name, t.value)
+	} else {
+		req.Header.Del(t.name)
+	}
+	return t.next.RoundTrip(req)
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// logTLSSettings explains QBITTORRENT_TLS_INSECURE and QBITTORRENT_CA_FILE at
+// startup. Both only matter for https URLs.
+func logTLSSettings(config *Config, urls []string) {
+	if !config.TLSInsecure && config.TLSRootCAs == nil {
+		return
+	}
+	https := false
+	for _, u := range urls {
+		if strings.HasPrefix(strings.ToLower(u), "https://") {
+			https = true
+		}
+	}
+	switch {
+	case !https:
+		slog.Warn("QBITTORRENT_TLS_INSECURE and QBITTORRENT_CA_FILE only apply to https URLs and have no effect here")
+	case config.TLSInsecure:
+		slog.Warn("TLS certificate verification is disabled (QBITTORRENT_TLS_INSECURE): anyone between here and the client can impersonate it and capture its credentials; prefer QBITTORRENT_CA_FILE")
+	default:
+		slog.Info("Trusting additional CA certificates for TLS", "ca_file", config.CAFile)
+	}
+}
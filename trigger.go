@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// syncTrigger funnels externally requested syncs into the main loop so they
+// run on the same serialized worker as scheduled ones. The queue holds at most
+// one pending request; further requests coalesce into it.
+type syncTrigger struct {
+	queue   chan string
+	running atomic.Bool
+}
+
+type triggerResult int
+
+const (
+	triggerQueued triggerResult = iota
+	triggerQueuedBehindRunning
+	triggerAlreadyQueued
+)
+
+func newSyncTrigger() *syncTrigger {
+	return &syncTrigger{queue: make(chan string, 1)}
+}
+
+func (t *syncTrigger) request(reason string) triggerResult {
+	select {
+	case t.queue <- reason:
+		if t.running.Load() {
+			return triggerQueuedBehindRunning
+		}
+		return triggerQueued
+	default:
+		return triggerAlreadyQueued
+	}
+}
+
+// run executes one sync cycle with the configured per-sync timeout.
+func (t *syncTrigger) run(ctx context.Context, timeout time.Duration, sync func(context.Context)) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	t.running.Store(true)
+	defer t.running.Store(false)
+	sync(ctx)
+}
+
+func (t *syncTrigger) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch t.request("HTTP request from " + r.RemoteAddr) {
+	case triggerQueued:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "sync queued")
+	case triggerQueuedBehindRunning:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "sync already running, follow-up sync queued")
+	case triggerAlreadyQueued:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, "sync already queued")
+	}
+}
+
+// watchFIFO requests a sync for every line written to the FIFO at path. The
+// FIFO is opened read-write so the open never blocks waiting for a writer and
+// reads never hit EOF between writers.
+func (t *syncTrigger) watchFIFO(ctx context.Context, path string) error {
+	if err := ensureFIFO(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open trigger FIFO: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if t.request("FIFO "+path) == triggerAlreadyQueued {
+				slog.Info("Sync already queued, ignoring FIFO trigger")
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			slog.Error("Trigger FIFO read failed", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// waitForURLs blocks until every WAIT_FOR_URLS entry answers with a 2xx, so
+// the tool can order its own startup behind gluetun and qBittorrent without
+// relying on the orchestrator. URLs that became healthy are not re-checked.
+func waitForURLs(ctx context.Context, urls []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	pending := append([]string(nil), urls...)
+	lastErr := make(map[string]string)
+
+	slog.Info("Waiting for dependencies", "urls", len(pending), "timeout", timeout)
+	for {
+		var still []string
+		for _, u := range pending {
+			if err := checkURL(ctx, client, u); err != nil {
+				if err.Error() != lastErr[u] {
+					slog.Info("Dependency not ready", "url", redactURL(u), "error", err)
+					lastErr[u] = err.Error()
+				}
+				still = append(still, u)
+				continue
+			}
+			slog.Info("Dependency ready", "url", redactURL(u))
+		}
+		pending = still
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d dependencies not ready: %w", len(pending), len(urls), ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func checkURL(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Values for WATCH_MODE.
+const (
+	watchModeWatch = "watch"
+	watchModePoll  = "poll"
+)
+
+const watchDebounce = 200 * time.Millisecond
+
+// watchPortFile requests a sync whenever one of the port files in spec is
+// written or replaced. The parent directories are watched rather than the
+// files themselves: gluetun replaces the file by rename, which would silently
+// end a watch on the old inode. The CHECK_INTERVAL ticker keeps running as a
+// safety net for missed events, and is all there is for a pattern whose
+// directory part is itself a pattern.
+func watchPortFile(ctx context.Context, spec string, trigger *syncTrigger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	watched := make(map[string]bool)
+	for _, entry := range portFileEntries(spec) {
+		entry = filepath.Clean(entry)
+		dir := filepath.Dir(entry)
+		if isGlob(dir) {
+			slog.Warn("Cannot watch a port file pattern across directories, relying on CHECK_INTERVAL polling", "path", entry)
+			continue
+		}
+		patterns = append(patterns, entry)
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+		watched[dir] = true
+	}
+	if len(patterns) == 0 {
+		watcher.Close()
+		return nil
+	}
+	slog.Info("Watching port file for changes", "path", strings.Join(patterns, ","))
+
+	// Writers often truncate and then write, which arrives as separate
+	// events; waiting briefly avoids reading the file half-written.
+	var debounce *time.Timer
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !matchesAny(patterns, filepath.Clean(ev.Name)) || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				slog.Debug("Port file event", "path", ev.Name, "op", ev.Op.String())
+				// A removal is usually the first half of a replace; the
+				// following create triggers the sync.
+				if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+					continue
+				}
+				reason := "port file " + ev.Op.String()
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(watchDebounce, func() { trigger.request(reason) })
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Port file watcher error, relying on CHECK_INTERVAL polling", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// matchesAny reports whether path is one of patterns or matches one of them
+// as a glob.
+func matchesAny(patterns []string, path string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, path); ok || p == path {
+			return true
+		}
+	}
+	return false
+}